@@ -0,0 +1,411 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ACLAction specifies decision of an ACL rule.
+type ACLAction int
+
+// Constants of ACLAction type.
+const (
+	// ACLAllow allows request or tunnel, keeping ConnectAction of OnConnect.
+	ACLAllow = ACLAction(iota)
+
+	// ACLDeny rejects request or tunnel by 403 response.
+	ACLDeny
+
+	// ACLMitm allows tunnel by ConnectMitm, so its requests are evaluated
+	// by ACL too. It's same as ACLAllow for requests.
+	ACLMitm
+
+	// ACLBypass allows tunnel by ConnectProxy, without "Man in the Middle".
+	// It's same as ACLAllow for requests.
+	ACLBypass
+)
+
+var aclActionNames = []string{"allow", "deny", "mitm", "bypass"}
+
+func (a ACLAction) String() string {
+	if a >= 0 && int(a) < len(aclActionNames) {
+		return aclActionNames[a]
+	}
+	return "ACLAction(" + strconv.Itoa(int(a)) + ")"
+}
+
+// ACLTimeWindow is a weekly time window.
+type ACLTimeWindow struct {
+	// Days of week. If it's empty, every day.
+	Days []time.Weekday
+
+	// Start and end of window in "15:04" format. If end is before start,
+	// window ends on the next day.
+	Start string
+	End   string
+
+	// Location of times.
+	// By default, time.Local.
+	Location *time.Location
+
+	start, end time.Duration
+}
+
+// ACLRule is a rule of ACL. A rule matches if all its conditions match; an
+// empty condition matches anything. Patterns of hosts and paths may contain
+// "*", matches any characters.
+type ACLRule struct {
+	// Name of rule, e.g. to log decisions.
+	Name string
+
+	// Decision of rule.
+	Action ACLAction
+
+	// Authenticated users.
+	Users []string
+
+	// Groups of authenticated user, see Context.AuthGroups.
+	Groups []string
+
+	// Client IP addresses or CIDRs, e.g. "10.0.0.0/8".
+	Clients []string
+
+	// Patterns of remote host names, e.g. "*.corp.example". They are matched
+	// case-insensitively to host names without trailing dot.
+	Hosts []string
+
+	// Remote ports.
+	Ports []int
+
+	// Request methods. Rules with Methods or Paths apply only to requests,
+	// plain or on ConnectMitm, unless Methods contains "CONNECT".
+	Methods []string
+
+	// Patterns of URL paths, e.g. "/api/*". They are matched to unescaped and
+	// cleaned paths, so "/a/../b" and "//b" match "/b".
+	Paths []string
+
+	// Time windows.
+	Times []ACLTimeWindow
+
+	clients []*net.IPNet
+}
+
+// ACL is an access control list evaluated on CONNECT and on requests. The
+// first matching rule decides; if no rule matches, DefaultAction decides.
+type ACL struct {
+	// Decision if no rule matches.
+	DefaultAction ACLAction
+
+	rules []*ACLRule
+}
+
+// NewACL returns a new ACL given default action and rules in order, and
+// validates rules.
+func NewACL(defaultAction ACLAction, rules ...ACLRule) (*ACL, error) {
+	acl := &ACL{DefaultAction: defaultAction}
+	for i := range rules {
+		rule := rules[i]
+		for _, c := range rule.Clients {
+			if ip := net.ParseIP(c); ip != nil {
+				if ip.To4() != nil {
+					c += "/32"
+				} else {
+					c += "/128"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(c)
+			if err != nil {
+				return nil, fmt.Errorf("ACL rule %q: %v", rule.Name, err)
+			}
+			rule.clients = append(rule.clients, ipNet)
+		}
+		methods := make([]string, len(rule.Methods))
+		for j, m := range rule.Methods {
+			methods[j] = strings.ToUpper(m)
+		}
+		rule.Methods = methods
+		times := make([]ACLTimeWindow, len(rule.Times))
+		for j, tw := range rule.Times {
+			start, err1 := time.Parse("15:04", tw.Start)
+			end, err2 := time.Parse("15:04", tw.End)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("ACL rule %q: invalid time window %s-%s", rule.Name, tw.Start, tw.End)
+			}
+			tw.start = time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute
+			tw.end = time.Duration(end.Hour())*time.Hour + time.Duration(end.Minute())*time.Minute
+			times[j] = tw
+		}
+		rule.Times = times
+		acl.rules = append(acl.rules, &rule)
+	}
+	return acl, nil
+}
+
+// aclRequest is subject of ACL evaluation.
+type aclRequest struct {
+	ctx     *Context
+	connect bool
+	host    string
+	port    int
+	method  string
+	path    string
+	now     time.Time
+}
+
+// evaluate returns decision and matched rule for request. If no rule
+// matches, rule is nil.
+func (acl *ACL) evaluate(req *aclRequest) (ACLAction, *ACLRule) {
+	for _, rule := range acl.rules {
+		if rule.match(req) {
+			return rule.Action, rule
+		}
+	}
+	return acl.DefaultAction, nil
+}
+
+func (rule *ACLRule) match(req *aclRequest) bool {
+	if req.connect && (len(rule.Paths) > 0 || (len(rule.Methods) > 0 && !aclContains(rule.Methods, "CONNECT"))) {
+		return false
+	}
+	ctx := req.ctx
+	if len(rule.Users) > 0 && (ctx.AuthUser == "" || !aclContains(rule.Users, ctx.AuthUser)) {
+		return false
+	}
+	if len(rule.Groups) > 0 {
+		found := false
+		for _, g := range ctx.AuthGroups {
+			if aclContains(rule.Groups, g) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.clients) > 0 {
+		ip := net.ParseIP(LimitKeyClientIP(ctx))
+		found := false
+		for _, ipNet := range rule.clients {
+			if ip != nil && ipNet.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.Hosts) > 0 && !aclMatchAny(rule.Hosts, req.host, true) {
+		return false
+	}
+	if len(rule.Ports) > 0 {
+		found := false
+		for _, p := range rule.Ports {
+			if p == req.port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.Methods) > 0 && !aclContains(rule.Methods, req.method) {
+		return false
+	}
+	if len(rule.Paths) > 0 && !aclMatchAny(rule.Paths, req.path, false) {
+		return false
+	}
+	if len(rule.Times) > 0 {
+		found := false
+		for i := range rule.Times {
+			if rule.Times[i].contains(req.now) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// contains checks t is in time window.
+func (tw *ACLTimeWindow) contains(t time.Time) bool {
+	if tw.Location != nil {
+		t = t.In(tw.Location)
+	}
+	day := t.Weekday()
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	if tw.end <= tw.start && offset < tw.end {
+		// In the part of window after midnight, which started yesterday.
+		day = (day + 6) % 7
+		offset += 24 * time.Hour
+	}
+	if len(tw.Days) > 0 {
+		found := false
+		for _, d := range tw.Days {
+			if d == day {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	end := tw.end
+	if end <= tw.start {
+		end += 24 * time.Hour
+	}
+	return offset >= tw.start && offset < end
+}
+
+// aclHost returns host name normalized to match, without trailing dot.
+func aclHost(host string) string {
+	return strings.TrimSuffix(host, ".")
+}
+
+// aclPath returns unescaped URL path p cleaned to match. Trailing slash is
+// kept, so "/a/" still matches "/a/*".
+func aclPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func aclContains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func aclMatchAny(patterns []string, s string, fold bool) bool {
+	if fold {
+		s = strings.ToLower(s)
+	}
+	for _, p := range patterns {
+		if fold {
+			p = strings.ToLower(p)
+		}
+		if aclMatch(p, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclMatch matches s to pattern, where "*" matches any characters.
+func aclMatch(pattern string, s string) bool {
+	star, backtrack := -1, 0
+	i, j := 0, 0
+	for j < len(s) {
+		switch {
+		case i < len(pattern) && pattern[i] == '*':
+			star, backtrack = i, j
+			i++
+		case i < len(pattern) && pattern[i] == s[j]:
+			i++
+			j++
+		case star >= 0:
+			backtrack++
+			i, j = star+1, backtrack
+		default:
+			return false
+		}
+	}
+	for i < len(pattern) && pattern[i] == '*' {
+		i++
+	}
+	return i == len(pattern)
+}
+
+// aclDenyError describes ACL denial. It's passed as opErr with ErrACLDenied.
+type aclDenyError struct {
+	rule *ACLRule
+	dest string
+}
+
+func (e *aclDenyError) Error() string {
+	if e.rule == nil {
+		return "access to " + e.dest + " denied by default"
+	}
+	return "access to " + e.dest + " denied by rule " + strconv.Quote(e.rule.Name)
+}
+
+// doConnectACL evaluates Proxy.ACL for CONNECT to host, and returns connect
+// action decided. If it's denied, it responds 403 to conn unless responded
+// is true, and returns ConnectNone. Matched rule is set to ctx.ACLRule.
+func (ctx *Context) doConnectACL(conn net.Conn, host string, responded bool) ConnectAction {
+	acl := ctx.Prx.ACL
+	if acl == nil || ctx.ConnectAction == ConnectNone {
+		return ctx.ConnectAction
+	}
+	h, p, _ := net.SplitHostPort(host)
+	port, _ := strconv.Atoi(p)
+	var action ACLAction
+	action, ctx.ACLRule = acl.evaluate(&aclRequest{ctx: ctx, connect: true, host: aclHost(h), port: port,
+		method: "CONNECT", now: time.Now()})
+	switch action {
+	case ACLDeny:
+		ctx.doError("Connect", ErrACLDenied, &aclDenyError{ctx.ACLRule, host})
+		if !responded {
+			if _, err := conn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n")); err != nil && !isConnectionClosed(err) {
+				ctx.doError("Connect", ErrResponseWrite, err)
+			}
+		}
+		return ConnectNone
+	case ACLMitm:
+		return ConnectMitm
+	case ACLBypass:
+		return ConnectProxy
+	}
+	return ctx.ConnectAction
+}
+
+// doRequestACL evaluates Proxy.ACL for request. If it's denied, it responds
+// 403 and returns true with error of response. Matched rule is set to
+// ctx.ACLRule.
+func (ctx *Context) doRequestACL(w http.ResponseWriter, r *http.Request) (bool, error) {
+	acl := ctx.Prx.ACL
+	if acl == nil {
+		return false, nil
+	}
+	host, port := r.URL.Hostname(), 80
+	if r.URL.Scheme == "https" {
+		port = 443
+	}
+	if p := r.URL.Port(); p != "" {
+		port, _ = strconv.Atoi(p)
+	}
+	var action ACLAction
+	action, ctx.ACLRule = acl.evaluate(&aclRequest{ctx: ctx, host: aclHost(host), port: port, method: r.Method,
+		path: aclPath(r.URL.Path), now: time.Now()})
+	if action != ACLDeny {
+		return false, nil
+	}
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+	ctx.doError("Request", ErrACLDenied, &aclDenyError{ctx.ACLRule, r.URL.Host})
+	err := ServeInMemory(w, http.StatusForbidden, nil, []byte(http.StatusText(http.StatusForbidden)))
+	ctx.doTunnelError("Request", ErrResponseWrite, err)
+	return true, err
+}
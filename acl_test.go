@@ -0,0 +1,198 @@
+package httpproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestACLMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"example.com", "example.com", true},
+		{"example.com", "example.org", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "www.example.com.evil", false},
+		{"/api/*", "/api/", true},
+		{"/api/*", "/api/v1/users", true},
+		{"/api/*", "/api", false},
+		{"/a*b*c", "/aXbYc", true},
+		{"/a*b*c", "/aXbYcZ", false},
+		{"/a*b*c", "/abbbc", true},
+		{"**", "x", true},
+	}
+	for _, tt := range tests {
+		if got := aclMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("aclMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestACLPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/admin/x", "/admin/x"},
+		{"/admin/", "/admin/"},
+		{"//admin/x", "/admin/x"},
+		{"/./admin/x", "/admin/x"},
+		{"/public/../secret", "/secret"},
+		{"/public/../../secret/", "/secret/"},
+		{"admin", "/admin"},
+	}
+	for _, tt := range tests {
+		if got := aclPath(tt.path); got != tt.want {
+			t.Errorf("aclPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestACLTimeWindowContains(t *testing.T) {
+	// 2024-01-01 is a Monday.
+	at := func(day int, hour int, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.UTC)
+	}
+	office := ACLTimeWindow{Days: []time.Weekday{time.Monday, time.Tuesday}, Start: "09:00", End: "17:00",
+		Location: time.UTC}
+	night := ACLTimeWindow{Days: []time.Weekday{time.Monday}, Start: "22:00", End: "06:00", Location: time.UTC}
+	allDay := ACLTimeWindow{Start: "00:00", End: "00:00", Location: time.UTC}
+	tests := []struct {
+		name string
+		tw   ACLTimeWindow
+		t    time.Time
+		want bool
+	}{
+		{"office start", office, at(1, 9, 0), true},
+		{"office before", office, at(1, 8, 59), false},
+		{"office end", office, at(2, 17, 0), false},
+		{"office other day", office, at(3, 12, 0), false},
+		{"night before midnight", night, at(1, 23, 0), true},
+		{"night after midnight", night, at(2, 5, 59), true},
+		{"night end", night, at(2, 6, 0), false},
+		{"night after midnight of other day", night, at(1, 1, 0), false},
+		{"night started on other day", night, at(2, 23, 0), false},
+		{"all day", allDay, at(4, 13, 30), true},
+		{"all day midnight", allDay, at(4, 0, 0), true},
+	}
+	for _, tt := range tests {
+		acl, err := NewACL(ACLDeny, ACLRule{Times: []ACLTimeWindow{tt.tw}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := acl.rules[0].Times[0].contains(tt.t); got != tt.want {
+			t.Errorf("%s: contains(%v) = %v, want %v", tt.name, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestACLEvaluate(t *testing.T) {
+	acl, err := NewACL(ACLAllow,
+		ACLRule{Name: "deny-connect", Action: ACLDeny, Hosts: []string{"blocked.example"}, Methods: []string{"connect"}},
+		ACLRule{Name: "deny-admin", Action: ACLDeny, Paths: []string{"/admin/*"}},
+		ACLRule{Name: "deny-post", Action: ACLDeny, Methods: []string{"POST"}},
+		ACLRule{Name: "mitm-social", Action: ACLMitm, Hosts: []string{"*.facebook.com"}},
+		ACLRule{Name: "users", Action: ACLBypass, Users: []string{"alice"}, Clients: []string{"10.0.0.0/8", "192.0.2.1"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &Context{Req: &http.Request{RemoteAddr: "10.1.2.3:5555"}}
+	tests := []struct {
+		name    string
+		req     aclRequest
+		user    string
+		want    ACLAction
+		rule    string
+		noMatch bool
+	}{
+		{"connect rule on CONNECT", aclRequest{connect: true, host: "blocked.example", port: 443, method: "CONNECT"},
+			"", ACLDeny, "deny-connect", false},
+		{"connect rule on request", aclRequest{host: "blocked.example", port: 80, method: "GET", path: "/"},
+			"", ACLAllow, "", true},
+		{"path rule skipped on CONNECT", aclRequest{connect: true, host: "example.com", port: 443, method: "CONNECT"},
+			"", ACLAllow, "", true},
+		{"path rule on request", aclRequest{host: "example.com", port: 80, method: "GET", path: "/admin/x"},
+			"", ACLDeny, "deny-admin", false},
+		{"method rule skipped on CONNECT", aclRequest{connect: true, host: "example.com", port: 443, method: "CONNECT"},
+			"", ACLAllow, "", true},
+		{"method rule on request", aclRequest{host: "example.com", port: 80, method: "POST", path: "/"},
+			"", ACLDeny, "deny-post", false},
+		{"host rule on CONNECT", aclRequest{connect: true, host: "www.facebook.com", port: 443, method: "CONNECT"},
+			"", ACLMitm, "mitm-social", false},
+		{"host rule case-insensitive", aclRequest{host: "WWW.Facebook.COM", port: 80, method: "GET", path: "/"},
+			"", ACLMitm, "mitm-social", false},
+		{"user and client", aclRequest{connect: true, host: "example.com", port: 443, method: "CONNECT"},
+			"alice", ACLBypass, "users", false},
+		{"other user", aclRequest{connect: true, host: "example.com", port: 443, method: "CONNECT"},
+			"bob", ACLAllow, "", true},
+	}
+	for _, tt := range tests {
+		ctx.AuthUser = tt.user
+		req := tt.req
+		req.ctx = ctx
+		action, rule := acl.evaluate(&req)
+		if action != tt.want {
+			t.Errorf("%s: action = %v, want %v", tt.name, action, tt.want)
+		}
+		if tt.noMatch {
+			if rule != nil {
+				t.Errorf("%s: rule = %q, want no match", tt.name, rule.Name)
+			}
+		} else if rule == nil || rule.Name != tt.rule {
+			t.Errorf("%s: rule = %v, want %q", tt.name, rule, tt.rule)
+		}
+	}
+}
+
+func TestACLRequestNormalization(t *testing.T) {
+	acl, err := NewACL(ACLDeny,
+		ACLRule{Name: "deny-facebook", Action: ACLDeny, Hosts: []string{"*.facebook.com"}},
+		ACLRule{Name: "deny-admin", Action: ACLDeny, Paths: []string{"/admin/*"}},
+		ACLRule{Name: "public", Action: ACLAllow, Paths: []string{"/public/*"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prx := &Proxy{ACL: acl}
+	tests := []struct {
+		url  string
+		deny bool
+	}{
+		{"http://example.com/public/a", false},
+		{"http://example.com/public/../secret", true},
+		{"http://example.com/public/%2e%2e/secret", true},
+		{"http://example.com//admin/x", true},
+		{"http://example.com/./admin/x", true},
+		{"http://example.com/public/../admin/x", true},
+		{"http://www.facebook.com./public/a", true},
+		{"http://WWW.FACEBOOK.COM/public/a", true},
+	}
+	for _, tt := range tests {
+		r, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := &Context{Prx: prx, Req: r}
+		w := httptest.NewRecorder()
+		deny, _ := ctx.doRequestACL(w, r)
+		if deny != tt.deny {
+			t.Errorf("%s: denied = %v, want %v", tt.url, deny, tt.deny)
+		}
+		if deny && w.Code != http.StatusForbidden {
+			t.Errorf("%s: status = %d, want %d", tt.url, w.Code, http.StatusForbidden)
+		}
+	}
+}
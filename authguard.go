@@ -0,0 +1,268 @@
+package httpproxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum number of client IPs and users whose failures are kept by
+// AuthGuard. Failures of others aren't counted while it's full.
+const authGuardMaxKeys = 1 << 16
+
+// AuthGuard protects authentication backends of proxy. After repeated
+// failures of a client IP, or a user if UserLockout is true, authentication
+// attempts are rejected without calling backends for an exponentially
+// growing backoff. Successful Basic authentications are cached by hashed
+// credentials. It's safe for concurrent use.
+type AuthGuard struct {
+	// Failures allowed for a client IP or a user before backoff.
+	// By default, 5.
+	MaxFailures int
+
+	// Backoff after MaxFailures failures. It doubles on each further
+	// failure.
+	// By default, 1 second.
+	Backoff time.Duration
+
+	// Maximum backoff, as a lockout.
+	// By default, 15 minutes.
+	MaxBackoff time.Duration
+
+	// Time after the last failure to forget failures.
+	// By default, 15 minutes.
+	FailureWindow time.Duration
+
+	// Counts failures of users too, besides client IPs. It stops guessing
+	// passwords of a user from many client IPs, but anyone can lock out a
+	// known user for MaxBackoff.
+	// By default, false.
+	UserLockout bool
+
+	// Time to cache successful Basic authentications. If it's zero, OnAuth
+	// is called for every request. Changes of backend, like a changed
+	// password or groups of user, take effect after that, unless Invalidate
+	// is called.
+	// By default, 0.
+	CacheTTL time.Duration
+
+	mu        sync.Mutex
+	failures  map[string]*authFailures
+	cache     map[string]*authCacheEntry
+	cacheKey  []byte
+	nextSweep time.Time
+}
+
+// authFailures keeps failures of a client IP or a user.
+type authFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// authCacheEntry is a cached successful authentication.
+type authCacheEntry struct {
+	user    string
+	groups  []string
+	expires time.Time
+}
+
+// authThrottleError describes which client IP or user is in backoff. It's
+// passed as opErr with ErrAuthThrottled.
+type authThrottleError struct {
+	key string
+}
+
+func (e *authThrottleError) Error() string {
+	return "authentication of " + e.key + " is throttled"
+}
+
+func (g *AuthGuard) failureWindow() time.Duration {
+	if g.FailureWindow > 0 {
+		return g.FailureWindow
+	}
+	return 15 * time.Minute
+}
+
+// sweep removes forgotten failures and expired cache entries. g.mu must be
+// locked.
+func (g *AuthGuard) sweep(now time.Time) {
+	if now.Before(g.nextSweep) {
+		return
+	}
+	for k, f := range g.failures {
+		if now.Sub(f.last) > g.failureWindow() && now.After(f.until) {
+			delete(g.failures, k)
+		}
+	}
+	for k, e := range g.cache {
+		if now.After(e.expires) {
+			delete(g.cache, k)
+		}
+	}
+	g.nextSweep = now.Add(time.Minute)
+}
+
+// blocked returns the first key in backoff and its remaining time.
+func (g *AuthGuard) blocked(keys []string) (string, time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for _, k := range keys {
+		if f := g.failures[k]; f != nil && now.Before(f.until) {
+			return k, f.until.Sub(now)
+		}
+	}
+	return "", 0
+}
+
+// fail counts a failure of keys.
+func (g *AuthGuard) fail(keys []string) {
+	maxFailures, backoff, maxBackoff := g.MaxFailures, g.Backoff, g.MaxBackoff
+	if maxFailures <= 0 {
+		maxFailures = 5
+	}
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = 15 * time.Minute
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	g.sweep(now)
+	if g.failures == nil {
+		g.failures = make(map[string]*authFailures)
+	}
+	for _, k := range keys {
+		f := g.failures[k]
+		if f == nil || now.Sub(f.last) > g.failureWindow() {
+			if f == nil && len(g.failures) >= authGuardMaxKeys {
+				continue
+			}
+			f = &authFailures{}
+			g.failures[k] = f
+		}
+		f.count++
+		f.last = now
+		if n := f.count - maxFailures; n >= 0 {
+			d := maxBackoff
+			if n < 30 && backoff<<uint(n) < maxBackoff {
+				d = backoff << uint(n)
+			}
+			f.until = now.Add(d)
+		}
+	}
+}
+
+// succeed forgets failures of key.
+func (g *AuthGuard) succeed(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.failures, key)
+}
+
+// credentialKey returns keyed hash of credentials, so cache never keeps
+// passwords.
+func (g *AuthGuard) credentialKey(user string, pass string) string {
+	if g.cacheKey == nil {
+		g.cacheKey = make([]byte, 32)
+		if _, err := rand.Read(g.cacheKey); err != nil {
+			panic(err)
+		}
+	}
+	h := hmac.New(sha256.New, g.cacheKey)
+	h.Write([]byte(user + "\x00" + pass))
+	return string(h.Sum(nil))
+}
+
+// cached returns groups of user if authentication of user with password is
+// cached.
+func (g *AuthGuard) cached(user string, pass string) ([]string, bool) {
+	if g.CacheTTL <= 0 {
+		return nil, false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e := g.cache[g.credentialKey(user, pass)]
+	if e == nil || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.groups, true
+}
+
+// store caches successful authentication of user with password.
+func (g *AuthGuard) store(user string, pass string, groups []string) {
+	if g.CacheTTL <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	g.sweep(now)
+	if g.cache == nil {
+		g.cache = make(map[string]*authCacheEntry)
+	}
+	g.cache[g.credentialKey(user, pass)] = &authCacheEntry{user: user, groups: groups, expires: now.Add(g.CacheTTL)}
+}
+
+// Invalidate removes cached authentications of user, e.g. after password or
+// groups of user changed in backend.
+func (g *AuthGuard) Invalidate(user string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for k, e := range g.cache {
+		if e.user == user {
+			delete(g.cache, k)
+		}
+	}
+}
+
+// authGuardKeys returns keys of client IP, and claimed user of credentials if
+// AuthGuard.UserLockout is true, to count failures.
+func (ctx *Context) authGuardKeys(authType string, authData string) []string {
+	keys := []string{"ip:" + LimitKeyClientIP(ctx)}
+	if !ctx.Prx.AuthGuard.UserLockout {
+		return keys
+	}
+	user := ""
+	switch authType {
+	case "Basic":
+		if userpass, err := base64.StdEncoding.DecodeString(authData); err == nil {
+			user = strings.SplitN(string(userpass), ":", 2)[0]
+		}
+	case "Digest":
+		user = parseAuthParams(authData)["username"]
+	}
+	if user != "" {
+		keys = append(keys, "user:"+user)
+	}
+	return keys
+}
+
+// doAuthThrottle rejects authentication attempt if client IP or user is in
+// backoff, by 429 response with Retry-After header.
+func (ctx *Context) doAuthThrottle(w http.ResponseWriter, r *http.Request, keys []string) bool {
+	key, d := ctx.Prx.AuthGuard.blocked(keys)
+	if d <= 0 {
+		return false
+	}
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+	ctx.doError("Auth", ErrAuthThrottled, &authThrottleError{key})
+	retryAfter := strconv.Itoa(int((d + time.Second - 1) / time.Second))
+	err := ServeInMemory(w, http.StatusTooManyRequests, map[string][]string{"Retry-After": {retryAfter}},
+		[]byte(http.StatusText(http.StatusTooManyRequests)))
+	if err != nil && !isConnectionClosed(err) {
+		ctx.doError("Auth", ErrResponseWrite, err)
+	}
+	return true
+}
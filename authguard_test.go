@@ -0,0 +1,177 @@
+package httpproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuthGuardBackoff(t *testing.T) {
+	g := &AuthGuard{MaxFailures: 3, Backoff: time.Second, MaxBackoff: 10 * time.Second}
+	keys := []string{"ip:192.0.2.1", "user:alice"}
+	want := []time.Duration{0, 0, 1, 2, 4, 8, 10, 10}
+	for i, w := range want {
+		g.fail(keys)
+		key, d := g.blocked(keys)
+		if w == 0 {
+			if d != 0 {
+				t.Errorf("failure %d: %s blocked for %v", i+1, key, d)
+			}
+			continue
+		}
+		if w *= time.Second; key != keys[0] || d > w || d < w-time.Second/2 {
+			t.Errorf("failure %d: %q blocked for %v, want %v", i+1, key, d, w)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		g.fail(keys)
+	}
+	if _, d := g.blocked(keys); d > 10*time.Second || d < 9*time.Second {
+		t.Errorf("after many failures: blocked for %v, want max backoff", d)
+	}
+	if key, d := g.blocked([]string{"ip:192.0.2.2", "user:bob"}); d != 0 {
+		t.Errorf("other keys: %s blocked for %v", key, d)
+	}
+
+	// Success forgets failures of the key.
+	g.succeed(keys[1])
+	if key, d := g.blocked(keys[1:]); d != 0 {
+		t.Errorf("after success: %s blocked for %v", key, d)
+	}
+	if key, _ := g.blocked(keys); key != keys[0] {
+		t.Errorf("after success of user: %q blocked, want %q", key, keys[0])
+	}
+
+	// Failures are forgotten after FailureWindow and backoff.
+	g.mu.Lock()
+	f := g.failures[keys[0]]
+	f.last, f.until = time.Now().Add(-time.Hour), time.Now()
+	g.mu.Unlock()
+	g.fail(keys[:1])
+	if key, d := g.blocked(keys); d != 0 {
+		t.Errorf("after failure window: %s blocked for %v", key, d)
+	}
+}
+
+func TestAuthGuardMaxKeys(t *testing.T) {
+	g := &AuthGuard{MaxFailures: 1}
+	for i := 0; i < authGuardMaxKeys; i++ {
+		g.fail([]string{fmt.Sprint("ip:", i)})
+	}
+	if len(g.failures) != authGuardMaxKeys {
+		t.Fatalf("%d keys, want %d", len(g.failures), authGuardMaxKeys)
+	}
+	// New keys aren't counted while it's full, but known keys are.
+	g.fail([]string{"ip:new", "ip:0"})
+	if len(g.failures) != authGuardMaxKeys || g.failures["ip:new"] != nil || g.failures["ip:0"].count != 2 {
+		t.Errorf("%d keys, new key %v, known key %+v", len(g.failures), g.failures["ip:new"], g.failures["ip:0"])
+	}
+
+	// Forgotten keys are swept, and new keys are counted again.
+	g.mu.Lock()
+	for _, f := range g.failures {
+		f.last, f.until = time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)
+	}
+	g.nextSweep = time.Time{}
+	g.mu.Unlock()
+	g.fail([]string{"ip:new"})
+	if len(g.failures) != 1 || g.failures["ip:new"] == nil {
+		t.Errorf("after sweep: %d keys", len(g.failures))
+	}
+}
+
+func TestAuthGuardCache(t *testing.T) {
+	g := &AuthGuard{}
+	g.store("alice", "secret", nil)
+	if _, ok := g.cached("alice", "secret"); ok {
+		t.Error("cached without CacheTTL")
+	}
+
+	g.CacheTTL = 100 * time.Millisecond
+	g.store("alice", "secret", []string{"staff"})
+	g.store("bob", "secret", nil)
+	if groups, ok := g.cached("alice", "secret"); !ok || !reflect.DeepEqual(groups, []string{"staff"}) {
+		t.Errorf("cached: %v, %v", groups, ok)
+	}
+	for _, c := range [][2]string{{"alice", "other"}, {"alice", ""}, {"carol", "secret"}, {"alice\x00secret", ""}} {
+		if _, ok := g.cached(c[0], c[1]); ok {
+			t.Errorf("cached %q with password %q", c[0], c[1])
+		}
+	}
+
+	g.Invalidate("alice")
+	if _, ok := g.cached("alice", "secret"); ok {
+		t.Error("cached after Invalidate")
+	}
+	if _, ok := g.cached("bob", "secret"); !ok {
+		t.Error("other user isn't cached after Invalidate")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, ok := g.cached("bob", "secret"); ok {
+		t.Error("cached after CacheTTL")
+	}
+}
+
+func TestAuthGuardProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prx.Rt = &http.Transport{}
+	calls := 0
+	prx.OnAuth = func(ctx *Context, authType string, user string, pass string) bool {
+		calls++
+		return user == "alice" && pass == "secret"
+	}
+	prx.AuthGuard = &AuthGuard{MaxFailures: 2, Backoff: time.Minute, UserLockout: true, CacheTTL: time.Minute}
+	srv := httptest.NewServer(prx)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	get := func(user string, pass string) *http.Response {
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := get("alice", "secret"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("valid credentials: status %d", resp.StatusCode)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("OnAuth is called %d times for cached credentials, want 1", calls)
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := get("alice", "wrong"); resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("failure %d: status %d", i+1, resp.StatusCode)
+		}
+	}
+	calls = 0
+	resp := get("alice", "secret")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "60" || calls != 0 {
+		t.Errorf("in backoff: status %d, Retry-After %q, %d OnAuth calls", resp.StatusCode, resp.Header.Get("Retry-After"), calls)
+	}
+	if key, _ := prx.AuthGuard.blocked([]string{"user:alice"}); key != "user:alice" {
+		t.Error("user isn't locked out")
+	}
+}
@@ -0,0 +1,109 @@
+package httpproxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ClientCertStore keeps client certificates to present to remote TLS servers.
+// Certificates are keyed by host pattern and optionally by authenticated proxy
+// user. Host patterns are matched with path.Match against host name without
+// port, e.g. "api.example.com", "*.example.com" or "*". It's safe for
+// concurrent use.
+type ClientCertStore struct {
+	mu      sync.RWMutex
+	entries []clientCertEntry
+}
+
+type clientCertEntry struct {
+	pattern string
+	user    string
+	cert    *tls.Certificate
+}
+
+// NewClientCertStore returns a new empty ClientCertStore.
+func NewClientCertStore() *ClientCertStore {
+	return &ClientCertStore{}
+}
+
+// Add adds certificate given host pattern and user. If user is "", the
+// certificate is used for all users.
+func (s *ClientCertStore) Add(pattern string, user string, cert tls.Certificate) error {
+	pattern = strings.ToLower(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, clientCertEntry{pattern: pattern, user: user, cert: &cert})
+	return nil
+}
+
+// AddPEMFile adds certificate loaded from PEM encoded certificate and key
+// files given host pattern and user.
+func (s *ClientCertStore) AddPEMFile(pattern string, user string, certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return s.Add(pattern, user, cert)
+}
+
+// AddPKCS12File adds certificate loaded from PKCS#12 (.p12, .pfx) file given
+// host pattern, user and file password. Files encrypted by AES or 3DES, and
+// legacy files with RC2-40 encrypted certificates, e.g. by openssl -legacy
+// or Windows export, are supported. Files without MAC aren't.
+func (s *ClientCertStore) AddPKCS12File(pattern string, user string, file string, password string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	cert, err := decodePKCS12(data, password)
+	if err != nil {
+		return err
+	}
+	return s.Add(pattern, user, cert)
+}
+
+// decodePKCS12 decodes certificate chain and private key of PKCS#12 data.
+func decodePKCS12(data []byte, password string) (tls.Certificate, error) {
+	key, leaf, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert := tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: key, Leaf: leaf}
+	for _, c := range caCerts {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
+
+// Lookup returns certificate given host and user. Certificates added for
+// user take precedence over certificates for all users, then first added
+// match wins. If there is no match, it returns nil.
+func (s *ClientCertStore) Lookup(host string, user string) *tls.Certificate {
+	host = strings.ToLower(stripPort(host))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var rv *tls.Certificate
+	for _, e := range s.entries {
+		if e.user != "" && e.user != user {
+			continue
+		}
+		if ok, _ := path.Match(e.pattern, host); !ok {
+			continue
+		}
+		if e.user != "" {
+			return e.cert
+		}
+		if rv == nil {
+			rv = e.cert
+		}
+	}
+	return rv
+}
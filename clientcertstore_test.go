@@ -0,0 +1,90 @@
+package httpproxy
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Files of testdata/pkcs12 are generated by OpenSSL 3.0 from client.pem, its
+// P-256 key and ca.pem, with password "secret":
+//
+//	openssl pkcs12 -export -in client.pem -inkey client.key -certfile ca.pem -out aes.p12
+//	openssl pkcs12 -export ... -keypbe PBE-SHA1-3DES -certpbe PBE-SHA1-3DES -macalg sha1 -out 3des.p12
+//	openssl pkcs12 -export ... -legacy -out legacy.p12
+//	openssl pkcs12 -export ... -legacy -certpbe PBE-SHA1-RC4-128 -out rc4.p12
+//	openssl pkcs12 -export ... -nomac -out nomac.p12
+//	openssl pkcs12 -export ... -keypbe NONE -certpbe NONE -out plain.p12
+
+func readTestPEM(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pkcs12", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := pem.Decode(data)
+	if b == nil {
+		t.Fatalf("%s: no PEM data", name)
+	}
+	return b.Bytes
+}
+
+func TestDecodePKCS12(t *testing.T) {
+	leaf, ca := readTestPEM(t, "client.pem"), readTestPEM(t, "ca.pem")
+	for _, name := range []string{"aes.p12", "3des.p12", "legacy.p12", "plain.p12"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "pkcs12", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := decodePKCS12(data, "secret")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(cert.Certificate) != 2 || !bytes.Equal(cert.Certificate[0], leaf) || !bytes.Equal(cert.Certificate[1], ca) {
+			t.Errorf("%s: certificate chain doesn't match client.pem and ca.pem", name)
+		}
+		if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "client" {
+			t.Errorf("%s: leaf = %v, want CN=client", name, cert.Leaf)
+		}
+		signer, ok := cert.PrivateKey.(crypto.Signer)
+		if !ok {
+			t.Errorf("%s: private key %T isn't a signer", name, cert.PrivateKey)
+			continue
+		}
+		if k, ok := cert.Leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !k.Equal(signer.Public()) {
+			t.Errorf("%s: private key doesn't match leaf", name)
+		}
+	}
+}
+
+func TestDecodePKCS12Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		err      string
+	}{
+		{"aes.p12", "wrong", pkcs12.ErrIncorrectPassword.Error()},
+		{"3des.p12", "wrong", pkcs12.ErrIncorrectPassword.Error()},
+		{"legacy.p12", "wrong", pkcs12.ErrIncorrectPassword.Error()},
+		{"rc4.p12", "secret", "pbe algorithm 1.2.840.113549.1.12.1.1 is not supported"},
+		{"nomac.p12", "secret", "no MAC"},
+	}
+	for _, tt := range tests {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "pkcs12", tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decodePKCS12(data, tt.password); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	if _, err := decodePKCS12([]byte("not pkcs12"), "secret"); err == nil {
+		t.Error("malformed data decoded")
+	}
+}
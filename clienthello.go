@@ -0,0 +1,449 @@
+package httpproxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Constants of TLS ClientHello fields.
+const (
+	tlsRecordHandshake        = 0x16
+	tlsHandshakeClientHello   = 0x01
+	tlsMaxClientHelloLen      = 0x10000
+	tlsExtServerName          = 0x0000
+	tlsExtSupportedGroups     = 0x000a
+	tlsExtECPointFormats      = 0x000b
+	tlsExtSignatureAlgorithms = 0x000d
+	tlsExtALPN                = 0x0010
+	tlsExtSessionTicket       = 0x0023
+	tlsExtSupportedVersions   = 0x002b
+	tlsMaxRecordLen           = 0x4800
+)
+
+// Timeout of peeking ClientHello before OnConnect callback, unless remote host
+// sends data first.
+const clientHelloPeekTimeout = time.Second
+
+const ja4EmptyHash = "000000000000"
+
+var (
+	errNotTLSHandshake   = errors.New("not TLS handshake")
+	errClientHelloFormat = errors.New("malformed TLS ClientHello")
+)
+
+// ClientHello keeps parsed TLS ClientHello message sent by client.
+type ClientHello struct {
+	// Raw handshake message, including handshake header.
+	Raw []byte
+
+	// Legacy version field of ClientHello.
+	Version uint16
+
+	// Session ID field of ClientHello.
+	SessionID []byte
+
+	// Cipher suites in client order, including GREASE values.
+	CipherSuites []uint16
+
+	// Compression methods in client order.
+	CompressionMethods []uint8
+
+	// Extension types in client order, including GREASE values.
+	Extensions []uint16
+
+	// Server name from server_name extension.
+	ServerName string
+
+	// Supported groups (elliptic curves) in client order.
+	SupportedGroups []uint16
+
+	// Elliptic curve point formats in client order.
+	PointFormats []uint8
+
+	// Signature algorithms in client order.
+	SignatureAlgorithms []uint16
+
+	// ALPN protocols in client order.
+	ALPNProtocols []string
+
+	// Supported versions in client order.
+	SupportedVersions []uint16
+}
+
+// ParseClientHello parses raw TLS ClientHello handshake message, including
+// handshake header.
+func ParseClientHello(msg []byte) (*ClientHello, error) {
+	if len(msg) < 4 || msg[0] != tlsHandshakeClientHello {
+		return nil, errClientHelloFormat
+	}
+	msgLen := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg) < 4+msgLen {
+		return nil, errClientHelloFormat
+	}
+	h := &ClientHello{Raw: msg[:4+msgLen]}
+	s := clientHelloReader(msg[4 : 4+msgLen])
+	var ok bool
+	if h.Version, ok = s.uint16(); !ok {
+		return nil, errClientHelloFormat
+	}
+	if _, ok = s.bytes(32); !ok {
+		return nil, errClientHelloFormat
+	}
+	if h.SessionID, ok = s.vector8(); !ok {
+		return nil, errClientHelloFormat
+	}
+	ciphers, ok := s.vector16()
+	if !ok {
+		return nil, errClientHelloFormat
+	}
+	if h.CipherSuites, ok = clientHelloReader(ciphers).uint16List(); !ok {
+		return nil, errClientHelloFormat
+	}
+	if h.CompressionMethods, ok = s.vector8(); !ok {
+		return nil, errClientHelloFormat
+	}
+	if len(s) == 0 {
+		return h, nil
+	}
+	exts, ok := s.vector16()
+	if !ok {
+		return nil, errClientHelloFormat
+	}
+	e := clientHelloReader(exts)
+	for len(e) > 0 {
+		extType, ok := e.uint16()
+		if !ok {
+			return nil, errClientHelloFormat
+		}
+		extData, ok := e.vector16()
+		if !ok {
+			return nil, errClientHelloFormat
+		}
+		h.Extensions = append(h.Extensions, extType)
+		if !h.parseExtension(extType, clientHelloReader(extData)) {
+			return nil, errClientHelloFormat
+		}
+	}
+	return h, nil
+}
+
+func (h *ClientHello) parseExtension(extType uint16, d clientHelloReader) bool {
+	var ok bool
+	switch extType {
+	case tlsExtServerName:
+		list, ok := d.vector16()
+		if !ok {
+			return false
+		}
+		l := clientHelloReader(list)
+		for len(l) > 0 {
+			nameType, ok := l.bytes(1)
+			if !ok {
+				return false
+			}
+			name, ok := l.vector16()
+			if !ok {
+				return false
+			}
+			if nameType[0] == 0 && h.ServerName == "" {
+				h.ServerName = string(name)
+			}
+		}
+	case tlsExtSupportedGroups:
+		list, ok := d.vector16()
+		if !ok {
+			return false
+		}
+		if h.SupportedGroups, ok = clientHelloReader(list).uint16List(); !ok {
+			return false
+		}
+	case tlsExtECPointFormats:
+		if h.PointFormats, ok = d.vector8(); !ok {
+			return false
+		}
+	case tlsExtSignatureAlgorithms:
+		list, ok := d.vector16()
+		if !ok {
+			return false
+		}
+		if h.SignatureAlgorithms, ok = clientHelloReader(list).uint16List(); !ok {
+			return false
+		}
+	case tlsExtALPN:
+		list, ok := d.vector16()
+		if !ok {
+			return false
+		}
+		l := clientHelloReader(list)
+		for len(l) > 0 {
+			proto, ok := l.vector8()
+			if !ok {
+				return false
+			}
+			h.ALPNProtocols = append(h.ALPNProtocols, string(proto))
+		}
+	case tlsExtSupportedVersions:
+		list, ok := d.vector8()
+		if !ok {
+			return false
+		}
+		if h.SupportedVersions, ok = clientHelloReader(list).uint16List(); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// JA3 returns JA3 fingerprint string of ClientHello.
+func (h *ClientHello) JA3() string {
+	points := make([]uint16, 0, len(h.PointFormats))
+	for _, p := range h.PointFormats {
+		points = append(points, uint16(p))
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		ja3List(h.CipherSuites),
+		ja3List(h.Extensions),
+		ja3List(h.SupportedGroups),
+		ja3List(points),
+	}, ",")
+}
+
+// JA3Hash returns MD5 hash of JA3 fingerprint string of ClientHello.
+func (h *ClientHello) JA3Hash() string {
+	sum := md5.Sum([]byte(h.JA3()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns JA4 fingerprint of ClientHello.
+func (h *ClientHello) JA4() string {
+	version := h.Version
+	if versions := withoutGREASE(h.SupportedVersions); len(versions) > 0 {
+		version = 0
+		for _, v := range versions {
+			if v > version {
+				version = v
+			}
+		}
+	}
+	var versionStr string
+	switch version {
+	case 0x0304:
+		versionStr = "13"
+	case 0x0303:
+		versionStr = "12"
+	case 0x0302:
+		versionStr = "11"
+	case 0x0301:
+		versionStr = "10"
+	case 0x0300:
+		versionStr = "s3"
+	default:
+		versionStr = "00"
+	}
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+	ciphers := withoutGREASE(h.CipherSuites)
+	exts := withoutGREASE(h.Extensions)
+	alpn := "00"
+	if len(h.ALPNProtocols) > 0 && h.ALPNProtocols[0] != "" {
+		p := h.ALPNProtocols[0]
+		if isAlnum(p[0]) && isAlnum(p[len(p)-1]) {
+			alpn = string([]byte{p[0], p[len(p)-1]})
+		} else {
+			x := hex.EncodeToString([]byte(p))
+			alpn = string([]byte{x[0], x[len(x)-1]})
+		}
+	}
+	var hashedExts []uint16
+	for _, e := range exts {
+		if e != tlsExtServerName && e != tlsExtALPN {
+			hashedExts = append(hashedExts, e)
+		}
+	}
+	sortUint16(ciphers)
+	sortUint16(hashedExts)
+	cipherHash := ja4EmptyHash
+	if len(ciphers) > 0 {
+		cipherHash = ja4Hash(ja4List(ciphers))
+	}
+	extHash := ja4EmptyHash
+	if len(hashedExts) > 0 {
+		s := ja4List(hashedExts)
+		if sigs := withoutGREASE(h.SignatureAlgorithms); len(sigs) > 0 {
+			s += "_" + ja4List(sigs)
+		}
+		extHash = ja4Hash(s)
+	}
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s", versionStr, sni, ja4Count(len(ciphers)),
+		ja4Count(len(exts)), alpn, cipherHash, extHash)
+}
+
+// peekClientHello reads TLS records from conn until whole ClientHello handshake
+// message is read. It returns all bytes read from conn to replay, even if an
+// error occurs.
+func peekClientHello(conn net.Conn, timeout time.Duration) (raw []byte, hello *ClientHello, err error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	var msg []byte
+	for {
+		hdr := make([]byte, 5)
+		n, err := io.ReadFull(conn, hdr)
+		raw = append(raw, hdr[:n]...)
+		if err != nil {
+			return raw, nil, err
+		}
+		if hdr[0] != tlsRecordHandshake {
+			return raw, nil, errNotTLSHandshake
+		}
+		recLen := int(binary.BigEndian.Uint16(hdr[3:]))
+		if recLen == 0 || recLen > tlsMaxRecordLen {
+			return raw, nil, errClientHelloFormat
+		}
+		rec := make([]byte, recLen)
+		n, err = io.ReadFull(conn, rec)
+		raw = append(raw, rec[:n]...)
+		if err != nil {
+			return raw, nil, err
+		}
+		msg = append(msg, rec...)
+		if len(msg) >= 4 {
+			if msg[0] != tlsHandshakeClientHello {
+				return raw, nil, errNotTLSHandshake
+			}
+			msgLen := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+			if msgLen > tlsMaxClientHelloLen {
+				return raw, nil, errClientHelloFormat
+			}
+			if len(msg) >= 4+msgLen {
+				hello, err = ParseClientHello(msg)
+				return raw, hello, err
+			}
+		}
+	}
+}
+
+// prefixConn is a net.Conn replays prefix bytes before reading from Conn.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+type clientHelloReader []byte
+
+func (s *clientHelloReader) bytes(n int) ([]byte, bool) {
+	if n < 0 || len(*s) < n {
+		return nil, false
+	}
+	b := (*s)[:n]
+	*s = (*s)[n:]
+	return b, true
+}
+
+func (s *clientHelloReader) uint16() (uint16, bool) {
+	b, ok := s.bytes(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b), true
+}
+
+func (s *clientHelloReader) vector8() ([]byte, bool) {
+	l, ok := s.bytes(1)
+	if !ok {
+		return nil, false
+	}
+	return s.bytes(int(l[0]))
+}
+
+func (s *clientHelloReader) vector16() ([]byte, bool) {
+	l, ok := s.uint16()
+	if !ok {
+		return nil, false
+	}
+	return s.bytes(int(l))
+}
+
+func (s clientHelloReader) uint16List() ([]uint16, bool) {
+	if len(s)%2 != 0 {
+		return nil, false
+	}
+	rv := make([]uint16, 0, len(s)/2)
+	for i := 0; i < len(s); i += 2 {
+		rv = append(rv, binary.BigEndian.Uint16(s[i:]))
+	}
+	return rv, true
+}
+
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func isAlnum(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func withoutGREASE(lst []uint16) []uint16 {
+	rv := make([]uint16, 0, len(lst))
+	for _, v := range lst {
+		if !isGREASE(v) {
+			rv = append(rv, v)
+		}
+	}
+	return rv
+}
+
+func sortUint16(lst []uint16) {
+	sort.Slice(lst, func(i, j int) bool { return lst[i] < lst[j] })
+}
+
+func ja3List(lst []uint16) string {
+	s := make([]string, 0, len(lst))
+	for _, v := range withoutGREASE(lst) {
+		s = append(s, strconv.Itoa(int(v)))
+	}
+	return strings.Join(s, "-")
+}
+
+func ja4List(lst []uint16) string {
+	s := make([]string, 0, len(lst))
+	for _, v := range lst {
+		s = append(s, fmt.Sprintf("%04x", v))
+	}
+	return strings.Join(s, ",")
+}
+
+func ja4Hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func ja4Count(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
@@ -0,0 +1,263 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClientHello returns a ClientHello handshake message given legacy
+// version, cipher suites and extensions. Extension data of known types are
+// built from fields of hello, and others are empty.
+func testClientHello(hello *ClientHello) []byte {
+	u16 := func(b []byte, v uint16) []byte { return binary.BigEndian.AppendUint16(b, v) }
+	vec16 := func(b []byte, v []byte) []byte { return append(u16(b, uint16(len(v))), v...) }
+	list16 := func(lst []uint16) []byte {
+		var b []byte
+		for _, v := range lst {
+			b = u16(b, v)
+		}
+		return b
+	}
+	var exts []byte
+	for _, e := range hello.Extensions {
+		var d []byte
+		switch e {
+		case tlsExtServerName:
+			d = vec16(nil, append([]byte{0}, vec16(nil, []byte(hello.ServerName))...))
+		case tlsExtSupportedGroups:
+			d = vec16(nil, list16(hello.SupportedGroups))
+		case tlsExtECPointFormats:
+			d = append([]byte{byte(len(hello.PointFormats))}, hello.PointFormats...)
+		case tlsExtSignatureAlgorithms:
+			d = vec16(nil, list16(hello.SignatureAlgorithms))
+		case tlsExtALPN:
+			var l []byte
+			for _, p := range hello.ALPNProtocols {
+				l = append(append(l, byte(len(p))), p...)
+			}
+			d = vec16(nil, l)
+		case tlsExtSupportedVersions:
+			l := list16(hello.SupportedVersions)
+			d = append([]byte{byte(len(l))}, l...)
+		}
+		exts = vec16(u16(exts, e), d)
+	}
+	body := u16(nil, hello.Version)
+	body = append(body, make([]byte, 32)...)
+	body = append(append(body, byte(len(hello.SessionID))), hello.SessionID...)
+	body = vec16(body, list16(hello.CipherSuites))
+	body = append(append(body, byte(len(hello.CompressionMethods))), hello.CompressionMethods...)
+	body = vec16(body, exts)
+	return append([]byte{tlsHandshakeClientHello, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func TestClientHelloFingerprints(t *testing.T) {
+	tests := []struct {
+		name    string
+		hello   *ClientHello
+		ja3     string
+		ja3Hash string
+		ja4     string
+	}{
+		{
+			// Example of JA3 README, with GREASE values added.
+			name: "JA3 README",
+			hello: &ClientHello{
+				Version:            0x0301,
+				CipherSuites:       []uint16{0x0a0a, 47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+				CompressionMethods: []uint8{0},
+				Extensions:         []uint16{0x1a1a, 0, 10, 11},
+				ServerName:         "example.com",
+				SupportedGroups:    []uint16{23, 24, 25},
+				PointFormats:       []uint8{0},
+			},
+			ja3:     "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0",
+			ja3Hash: "ada70206e40642a3e4461f35503241d5",
+		},
+		{
+			// Chrome example of JA4 technical details.
+			name: "JA4 Chrome",
+			hello: &ClientHello{
+				Version: 0x0303,
+				CipherSuites: []uint16{0x2a2a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+					0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+				CompressionMethods: []uint8{0},
+				Extensions: []uint16{0x3a3a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005,
+					0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x4469, 0x0015, 0x4a4a},
+				ServerName:          "www.google.com",
+				SupportedGroups:     []uint16{0x5a5a, 0x001d, 0x0017, 0x0018},
+				PointFormats:        []uint8{0},
+				SignatureAlgorithms: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+				ALPNProtocols:       []string{"h2", "http/1.1"},
+				SupportedVersions:   []uint16{0x6a6a, 0x0304, 0x0303},
+			},
+			ja4: "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+	}
+	for _, tt := range tests {
+		raw := testClientHello(tt.hello)
+		h, err := ParseClientHello(raw)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		tt.hello.Raw = raw
+		tt.hello.SessionID = []byte{}
+		if !reflect.DeepEqual(h, tt.hello) {
+			t.Errorf("%s: parsed %+v, want %+v", tt.name, h, tt.hello)
+		}
+		if tt.ja3 != "" && h.JA3() != tt.ja3 {
+			t.Errorf("%s: JA3 %s, want %s", tt.name, h.JA3(), tt.ja3)
+		}
+		if tt.ja3Hash != "" && h.JA3Hash() != tt.ja3Hash {
+			t.Errorf("%s: JA3 hash %s, want %s", tt.name, h.JA3Hash(), tt.ja3Hash)
+		}
+		if tt.ja4 != "" && h.JA4() != tt.ja4 {
+			t.Errorf("%s: JA4 %s, want %s", tt.name, h.JA4(), tt.ja4)
+		}
+	}
+}
+
+func TestParseClientHelloError(t *testing.T) {
+	raw := testClientHello(&ClientHello{Version: 0x0303, CipherSuites: []uint16{0x1301},
+		CompressionMethods: []uint8{0}, Extensions: []uint16{tlsExtALPN}, ALPNProtocols: []string{"h2"}})
+	for n := 0; n < len(raw); n++ {
+		if _, err := ParseClientHello(raw[:n]); err != errClientHelloFormat {
+			t.Errorf("%d of %d bytes: %v, want %v", n, len(raw), err, errClientHelloFormat)
+		}
+	}
+	bad := append([]byte(nil), raw...)
+	bad[len(bad)-3]++ // ALPN protocol length
+	if _, err := ParseClientHello(bad); err != errClientHelloFormat {
+		t.Errorf("malformed ALPN: %v, want %v", err, errClientHelloFormat)
+	}
+}
+
+func TestPeekClientHello(t *testing.T) {
+	msg := testClientHello(&ClientHello{Version: 0x0303, CipherSuites: []uint16{0x1301},
+		CompressionMethods: []uint8{0}, Extensions: []uint16{tlsExtServerName}, ServerName: "example.com"})
+	// ClientHello is fragmented into records of 16 bytes.
+	var records []byte
+	for b := msg; len(b) > 0; {
+		n := 16
+		if n > len(b) {
+			n = len(b)
+		}
+		records = append(records, tlsRecordHandshake, 3, 1, 0, byte(n))
+		records = append(records, b[:n]...)
+		b = b[n:]
+	}
+	tests := []struct {
+		data    []byte
+		raw     []byte
+		hello   bool
+		wantErr error
+	}{
+		{append(records, "data"...), records, true, nil},
+		{[]byte("GET / HTTP/1.1\r\n\r\n"), []byte("GET /"), false, errNotTLSHandshake},
+		{[]byte{tlsRecordHandshake, 3, 1, 0, 0}, []byte{tlsRecordHandshake, 3, 1, 0, 0}, false, errClientHelloFormat},
+	}
+	for i, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(tt.data)
+			client.Close()
+		}()
+		raw, hello, err := peekClientHello(server, time.Second)
+		server.Close()
+		if !bytes.Equal(raw, tt.raw) || (hello != nil) != tt.hello || err != tt.wantErr {
+			t.Errorf("%d: raw %q, hello %v, error %v", i, raw, hello, err)
+		}
+		if hello != nil && hello.ServerName != "example.com" {
+			t.Errorf("%d: server name %q", i, hello.ServerName)
+		}
+	}
+
+	// Peeking ends at timeout, if client waits for server.
+	client, server := net.Pipe()
+	defer client.Close()
+	start := time.Now()
+	if _, _, err := peekClientHello(server, 50*time.Millisecond); !isTimeout(err) || time.Since(start) > time.Second {
+		t.Errorf("timeout: %v in %v", err, time.Since(start))
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestPeekClientHelloConnect(t *testing.T) {
+	cert := testCertificate(t)
+	var accepted int32
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+			go func() {
+				defer tlsConn.Close()
+				tlsConn.Write([]byte("hello"))
+			}()
+		}
+	}()
+
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prx.PeekClientHello = true
+	type connectInfo struct {
+		dialed bool
+		ja4    string
+	}
+	connects := make(chan connectInfo, 1)
+	prx.OnConnect = func(ctx *Context, host string) (ConnectAction, string) {
+		connects <- connectInfo{atomic.LoadInt32(&accepted) > 0, ctx.JA4}
+		return ConnectProxy, host
+	}
+	srv := httptest.NewServer(prx)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("CONNECT " + l.Addr().String() + " HTTP/1.1\r\nHost: " + l.Addr().String() + "\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v, %v", resp, err)
+	}
+	tlsConn := tls.Client(&readerConn{Conn: conn, r: r}, &tls.Config{InsecureSkipVerify: true})
+	b := make([]byte, 5)
+	if _, err := tlsConn.Read(b); err != nil || string(b) != "hello" {
+		t.Errorf("tunnel read %q, %v", b, err)
+	}
+	info := <-connects
+	// Remote host isn't dialed until OnConnect decides the tunnel.
+	if info.dialed {
+		t.Error("remote host is dialed before OnConnect")
+	}
+	if info.ja4 == "" || info.ja4[:4] != "t13i" {
+		t.Errorf("JA4 in OnConnect %q", info.ja4)
+	}
+}
@@ -0,0 +1,209 @@
+package httpproxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeouts of connection auth states, if Proxy.ConnState doesn't remove them.
+const (
+	connAuthHandshakeTimeout = time.Minute
+	connAuthIdleTimeout      = 5 * time.Minute
+)
+
+// ConnAuthenticator authenticates client connections by a multi-round
+// challenge/response handshake, e.g. NTLM or Negotiate. A handshake spans
+// several requests on the same client connection, and a connection stays
+// authenticated after it.
+type ConnAuthenticator interface {
+	// Scheme returns authentication scheme, e.g. "NTLM" or "Negotiate".
+	Scheme() string
+
+	// NewSession returns a new handshake session of a client connection.
+	NewSession(ctx *Context) ConnAuthSession
+}
+
+// ConnAuthSession is a handshake session of a client connection.
+type ConnAuthSession interface {
+	// Step processes token sent by client. It returns token to send back in
+	// challenge, or authenticated user if done is true. If err is non-nil,
+	// authentication fails.
+	Step(ctx *Context, token []byte) (out []byte, user string, done bool, err error)
+}
+
+// connAuthState keeps auth state of a client connection.
+type connAuthState struct {
+	session ConnAuthSession
+	user    string
+	expires time.Time
+}
+
+// connAuthStates keeps auth states by client connection, and open client
+// connections reported by Proxy.ConnState.
+type connAuthStates struct {
+	mu        sync.Mutex
+	states    map[string]*connAuthState
+	conns     map[string]bool
+	nextSweep time.Time
+}
+
+// errConnStateUnset is passed as opErr with ErrAuthScheme if Proxy.ConnAuth
+// is set without Proxy.ConnState.
+var errConnStateUnset = errors.New("Proxy.ConnState isn't set to http.Server.ConnState")
+
+func (s *connAuthStates) get(key string) *connAuthState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.After(s.nextSweep) {
+		for k, v := range s.states {
+			if now.After(v.expires) {
+				delete(s.states, k)
+			}
+		}
+		s.nextSweep = now.Add(time.Minute)
+	}
+	st := s.states[key]
+	if st == nil || now.After(st.expires) {
+		return nil
+	}
+	return st
+}
+
+// user returns authenticated user of key, and extends expiry of the state.
+// If key isn't authenticated, it returns "".
+func (s *connAuthStates) user(key string) string {
+	st := s.get(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st == nil || st.user == "" {
+		return ""
+	}
+	st.expires = time.Now().Add(connAuthIdleTimeout)
+	return st.user
+}
+
+func (s *connAuthStates) set(key string, st *connAuthState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.states == nil {
+		s.states = make(map[string]*connAuthState)
+	}
+	s.states[key] = st
+}
+
+func (s *connAuthStates) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, key)
+}
+
+// open marks client connection of key open or closed. States of key are
+// removed in both cases, so a new connection from the same address never
+// inherits them.
+func (s *connAuthStates) open(key string, open bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[string]bool)
+	}
+	if open {
+		s.conns[key] = true
+	} else {
+		delete(s.conns, key)
+	}
+	delete(s.states, key)
+}
+
+// isOpen checks client connection of key is reported open.
+func (s *connAuthStates) isOpen(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns[key]
+}
+
+// connAuthKey returns key of client connection of request.
+func connAuthKey(r *http.Request) string {
+	key := r.RemoteAddr
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		key += "|" + addr.String()
+	}
+	return key
+}
+
+// ConnState tracks client connections for Proxy.ConnAuth, whose handshake
+// states are kept by address of client connection, and counts new
+// connections for Limits.ConnectionsPerSecond. If Proxy.ConnAuth is set, it
+// must be set to http.Server.ConnState, so a new connection from the same
+// address never inherits authentication of a closed one. Otherwise, requests
+// are responded by 500 and reported as ErrAuthScheme.
+func (prx *Proxy) ConnState(conn net.Conn, state http.ConnState) {
+	key := conn.RemoteAddr().String() + "|" + conn.LocalAddr().String()
+	if prx.Limits != nil {
+		ip := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		prx.Limits.connState(key, ip, state)
+	}
+	switch state {
+	case http.StateNew:
+		prx.connAuthStates.open(key, true)
+	case http.StateClosed, http.StateHijacked:
+		prx.connAuthStates.open(key, false)
+	}
+}
+
+// doConnAuth authenticates request by Proxy.ConnAuth. If authentication
+// succeeded, it returns true. Otherwise, it returns token to send in
+// challenge and whether client sent invalid credentials.
+func (ctx *Context) doConnAuth(r *http.Request, authType string, authData string) (ok bool, out []byte, unauthorized bool) {
+	ca := ctx.Prx.ConnAuth
+	key := connAuthKey(r)
+	if authType != ca.Scheme() {
+		if user := ctx.Prx.connAuthStates.user(key); user != "" {
+			ctx.AuthUser = user
+			return true, nil, false
+		}
+		return false, nil, false
+	}
+	token, err := base64.StdEncoding.DecodeString(strings.TrimSpace(authData))
+	if err != nil {
+		ctx.Prx.connAuthStates.remove(key)
+		return false, nil, true
+	}
+	st := ctx.Prx.connAuthStates.get(key)
+	if st == nil || st.session == nil {
+		st = &connAuthState{session: ca.NewSession(ctx)}
+	}
+	out, user, done, err := ctx.onConnAuthStep(st.session, token)
+	if err != nil {
+		ctx.Prx.connAuthStates.remove(key)
+		ctx.doError("Auth", ErrConnAuth, err)
+		return false, nil, true
+	}
+	if done {
+		ctx.Prx.connAuthStates.set(key, &connAuthState{user: user,
+			expires: time.Now().Add(connAuthIdleTimeout)})
+		ctx.AuthUser = user
+		return true, out, false
+	}
+	ctx.Prx.connAuthStates.set(key, &connAuthState{session: st.session,
+		expires: time.Now().Add(connAuthHandshakeTimeout)})
+	return false, out, false
+}
+
+func (ctx *Context) onConnAuthStep(session ConnAuthSession, token []byte) (out []byte, user string, done bool, err error) {
+	defer func() {
+		if e, ok := recover().(error); ok {
+			ctx.doError("Auth", ErrPanic, e)
+			out, user, done, err = nil, "", false, e
+		}
+	}()
+	return session.Step(ctx, token)
+}
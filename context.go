@@ -4,12 +4,15 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
-	"io"
+	"errors"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Context keeps context of each proxy request.
@@ -40,11 +43,77 @@ type Context struct {
 	// It's using internally. Don't change in Context struct!
 	ConnectHost string
 
+	// Authenticated user name, if proxy authentication succeeded.
+	AuthUser string
+
+	// Authentication scheme of authenticated user, e.g. "Basic", or
+	// "Certificate" if user is authenticated by Proxy.OnCertAuth.
+	AuthScheme string
+
+	// Groups of authenticated user, if authenticator resolves them, e.g.
+	// LDAPAuthenticator.
+	AuthGroups []string
+
+	// ACL rule matched last, if Proxy.ACL is set. It's nil if no rule
+	// matched and default action is applied.
+	ACLRule *ACLRule
+
+	// Claims of JWT, if proxy authentication succeeded by Bearer scheme.
+	// They're available to later callbacks, e.g. OnConnect and OnRequest.
+	Claims map[string]interface{}
+
+	// Client certificate to present to remote TLS server. If it's nil before
+	// remote request, it's looked up from Proxy.ClientCerts.
+	RemoteClientCert *tls.Certificate
+
+	// Verified certificate presented by client on TLS proxy listener, if
+	// listener requests client certificates.
+	ProxyClientCert *x509.Certificate
+
+	// Certificates presented by client on ConnectMitm, if
+	// Proxy.MitmClientAuth requests them. They aren't verified unless
+	// MitmClientAuth verifies them.
+	MitmClientCerts []*x509.Certificate
+
+	// TLS ClientHello of client, if Proxy.PeekClientHello is true or
+	// ConnectAction is ConnectMitm. Otherwise, nil.
+	ClientHello *ClientHello
+
+	// JA3 fingerprint hash of ClientHello, if ClientHello isn't nil.
+	JA3 string
+
+	// JA4 fingerprint of ClientHello, if ClientHello isn't nil.
+	JA4 string
+
 	// User data to use free.
 	UserData interface{}
 
 	hijTLSConn   *tls.Conn
 	hijTLSReader *bufio.Reader
+	mitmConn     net.Conn
+	pcapStream   *PcapngStream
+	peeked       bool
+	peekedBytes  []byte
+	mitmVerified bool
+	tunnel       *tunnelState
+	timeouts     *tunnelTimeouts
+	limitKey     string
+	limitTunnel  bool
+	limitMitm    bool
+	shaped       []*shapeBucket
+}
+
+type proxyContextKey struct{}
+
+// ProxyContext returns proxy Context from context of remote request given to
+// Proxy.Rt. If the request isn't sent by proxy, it returns nil.
+func ProxyContext(c context.Context) *Context {
+	ctx, _ := c.Value(proxyContextKey{}).(*Context)
+	return ctx
+}
+
+func withProxyContext(ctx *Context, r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), proxyContextKey{}, ctx))
 }
 
 func (ctx *Context) onAccept(w http.ResponseWriter, r *http.Request) bool {
@@ -65,6 +134,16 @@ func (ctx *Context) onAuth(authType string, user string, pass string) bool {
 	return ctx.Prx.OnAuth(ctx, authType, user, pass)
 }
 
+func (ctx *Context) onCertAuth(cert *x509.Certificate) (user string, ok bool) {
+	defer func() {
+		if err, ok2 := recover().(error); ok2 {
+			ctx.doError("Auth", ErrPanic, err)
+			user, ok = "", false
+		}
+	}()
+	return ctx.Prx.OnCertAuth(ctx, cert)
+}
+
 func (ctx *Context) onConnect(host string) (ConnectAction ConnectAction,
 	newHost string) {
 	defer func() {
@@ -75,6 +154,24 @@ func (ctx *Context) onConnect(host string) (ConnectAction ConnectAction,
 	return ctx.Prx.OnConnect(ctx, host)
 }
 
+func (ctx *Context) onMitmTLSConfig(config *tls.Config) {
+	defer func() {
+		if err, ok := recover().(error); ok {
+			ctx.doError("Connect", ErrPanic, err)
+		}
+	}()
+	ctx.Prx.OnMitmTLSConfig(ctx, config)
+}
+
+func (ctx *Context) onMitmClientCert(certs []*x509.Certificate) (remoteCert *tls.Certificate) {
+	defer func() {
+		if err, ok := recover().(error); ok {
+			ctx.doError("Connect", ErrPanic, err)
+		}
+	}()
+	return ctx.Prx.OnMitmClientCert(ctx, certs)
+}
+
 func (ctx *Context) onRequest(req *http.Request) (resp *http.Response) {
 	defer func() {
 		if err, ok := recover().(error); ok {
@@ -122,43 +219,112 @@ func (ctx *Context) doAuth(w http.ResponseWriter, r *http.Request) bool {
 	if r.Method != "CONNECT" && !r.URL.IsAbs() {
 		return false
 	}
-	if ctx.Prx.OnAuth == nil {
-		return false
+	if ctx.Prx.OnCertAuth != nil && ctx.ProxyClientCert != nil {
+		if user, ok := ctx.onCertAuth(ctx.ProxyClientCert); ok {
+			ctx.AuthUser, ctx.AuthScheme = user, "Certificate"
+			return false
+		}
+	}
+	schemes, err := ctx.authSchemes()
+	if err == nil && ctx.Prx.ConnAuth != nil && !ctx.Prx.connAuthStates.isOpen(connAuthKey(r)) {
+		err = errConnStateUnset
+	}
+	if err != nil {
+		if r.Body != nil {
+			defer r.Body.Close()
+		}
+		ctx.doError("Auth", ErrAuthScheme, err)
+		err = ServeInMemory(w, http.StatusInternalServerError, nil,
+			[]byte(http.StatusText(http.StatusInternalServerError)))
+		if err != nil && !isConnectionClosed(err) {
+			ctx.doError("Auth", ErrResponseWrite, err)
+		}
+		return true
 	}
-	prxAuthType := ctx.Prx.AuthType
-	if prxAuthType == "" {
-		prxAuthType = "Basic"
+	if schemes == nil && ctx.Prx.OnCertAuth == nil {
+		return false
 	}
 	unauthorized := false
+	stale := false
+	var challengeToken []byte
 	authParts := strings.SplitN(r.Header.Get("Proxy-Authorization"), " ", 2)
+	authType := ""
+	for _, scheme := range schemes {
+		if strings.EqualFold(authParts[0], scheme) {
+			authType = scheme
+		}
+	}
+	authData := ""
 	if len(authParts) >= 2 {
-		authType := authParts[0]
-		authData := authParts[1]
-		if prxAuthType == authType {
-			unauthorized = true
-			switch authType {
-			case "Basic":
-				userpassraw, err := base64.StdEncoding.DecodeString(authData)
-				if err == nil {
-					userpass := strings.SplitN(string(userpassraw), ":", 2)
-					if len(userpass) >= 2 && ctx.onAuth(authType, userpass[0], userpass[1]) {
-						return false
-					}
-				}
-			default:
-				unauthorized = false
-			}
+		authData = authParts[1]
+	}
+	connScheme := ""
+	if ctx.Prx.ConnAuth != nil {
+		connScheme = ctx.Prx.ConnAuth.Scheme()
+	}
+	guard := ctx.Prx.AuthGuard
+	var guardKeys []string
+	if guard != nil && authType != "" && len(authParts) >= 2 {
+		guardKeys = ctx.authGuardKeys(authType, authData)
+		if ctx.doAuthThrottle(w, r, guardKeys) {
+			return true
 		}
 	}
+	ok := false
+	scheme := authType
+	if connScheme != "" && (authType == "" || authType == connScheme) {
+		scheme = connScheme
+		ok, challengeToken, unauthorized = ctx.doConnAuth(r, authType, authData)
+	} else if authType != "" && len(authParts) >= 2 {
+		unauthorized = true
+		switch authType {
+		case "Basic":
+			ok = ctx.doBasicAuth(authData)
+		case "Digest":
+			ok, stale = ctx.doDigestAuth(r, authData)
+			unauthorized = !stale
+		case "Bearer":
+			ok = ctx.doBearerAuth(authData)
+		default:
+			unauthorized = false
+		}
+	}
+	if ok {
+		ctx.AuthScheme = scheme
+		if len(guardKeys) > 1 {
+			guard.succeed(guardKeys[1])
+		}
+		return false
+	}
+	if unauthorized && guardKeys != nil {
+		guard.fail(guardKeys)
+	}
 	if r.Body != nil {
 		defer r.Body.Close()
 	}
+	if len(schemes) == 0 {
+		// Only certificate authentication is configured, and 407 without a
+		// challenge isn't allowed.
+		err = ServeInMemory(w, http.StatusForbidden, nil, []byte(http.StatusText(http.StatusForbidden)))
+		if err != nil && !isConnectionClosed(err) {
+			ctx.doError("Auth", ErrResponseWrite, err)
+		}
+		return true
+	}
 	respCode := 407
 	respBody := "Proxy Authentication Required"
 	if unauthorized {
 		respBody += " [Unauthorized]"
 	}
-	err := ServeInMemory(w, respCode, map[string][]string{"Proxy-Authenticate": {prxAuthType}},
+	var challenges []string
+	if len(challengeToken) > 0 {
+		challenges = []string{connScheme + " " + base64.StdEncoding.EncodeToString(challengeToken)}
+	} else {
+		for _, scheme := range schemes {
+			challenges = append(challenges, ctx.authChallenges(scheme, unauthorized && scheme == authType, stale)...)
+		}
+	}
+	err = ServeInMemory(w, respCode, map[string][]string{"Proxy-Authenticate": challenges},
 		[]byte(respBody))
 	if err != nil && !isConnectionClosed(err) {
 		ctx.doError("Auth", ErrResponseWrite, err)
@@ -166,6 +332,111 @@ func (ctx *Context) doAuth(w http.ResponseWriter, r *http.Request) bool {
 	return true
 }
 
+// doBasicAuth verifies Basic credentials by OnAuth, or by cache of
+// Proxy.AuthGuard.
+func (ctx *Context) doBasicAuth(data string) bool {
+	userpassraw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return false
+	}
+	userpass := strings.SplitN(string(userpassraw), ":", 2)
+	if len(userpass) < 2 {
+		return false
+	}
+	user, pass := userpass[0], userpass[1]
+	guard := ctx.Prx.AuthGuard
+	if guard != nil {
+		if groups, ok := guard.cached(user, pass); ok {
+			ctx.AuthUser, ctx.AuthGroups = user, groups
+			return true
+		}
+	}
+	if !ctx.onAuth("Basic", user, pass) {
+		return false
+	}
+	ctx.AuthUser = user
+	if guard != nil {
+		guard.store(user, pass, ctx.AuthGroups)
+	}
+	return true
+}
+
+// authSchemeError describes an authentication scheme without a handler. It's
+// passed as opErr with ErrAuthScheme.
+type authSchemeError struct {
+	scheme string
+}
+
+func (e *authSchemeError) Error() string {
+	if e.scheme == "" {
+		return "no authentication scheme offered"
+	}
+	return "no handler of authentication scheme " + strconv.Quote(e.scheme)
+}
+
+// authSchemes returns authentication schemes offered to client, in order of
+// preference. If no authentication handler is configured, it returns nil.
+// It returns an error if a scheme has no handler, or no scheme is offered
+// and Proxy.OnCertAuth isn't set, so misconfiguration never disables
+// authentication.
+func (ctx *Context) authSchemes() ([]string, error) {
+	prx := ctx.Prx
+	if prx.OnAuth == nil && prx.OnDigestAuth == nil && prx.JWTVerifier == nil && prx.ConnAuth == nil &&
+		prx.OnCertAuth == nil {
+		return nil, nil
+	}
+	schemes := prx.AuthTypes
+	if len(schemes) == 0 {
+		if prx.ConnAuth != nil {
+			schemes = []string{prx.ConnAuth.Scheme()}
+		} else if prx.AuthType != "" {
+			schemes = []string{prx.AuthType}
+		} else if prx.OnAuth != nil {
+			schemes = []string{"Basic"}
+		}
+	}
+	for _, scheme := range schemes {
+		handled := false
+		switch {
+		case prx.ConnAuth != nil && scheme == prx.ConnAuth.Scheme():
+			handled = true
+		case scheme == "Basic":
+			handled = prx.OnAuth != nil
+		case scheme == "Digest":
+			handled = prx.OnDigestAuth != nil
+		case scheme == "Bearer":
+			handled = prx.JWTVerifier != nil
+		}
+		if !handled {
+			return nil, &authSchemeError{scheme}
+		}
+	}
+	if len(schemes) == 0 && prx.OnCertAuth == nil {
+		return nil, &authSchemeError{}
+	}
+	return schemes, nil
+}
+
+// authChallenges returns Proxy-Authenticate header values of scheme with its
+// realm and parameters.
+func (ctx *Context) authChallenges(scheme string, unauthorized bool, stale bool) []string {
+	realm := `realm="` + strings.ReplaceAll(ctx.authRealm(), `"`, `\"`) + `"`
+	switch {
+	case ctx.Prx.ConnAuth != nil && scheme == ctx.Prx.ConnAuth.Scheme():
+		return []string{scheme}
+	case scheme == "Digest":
+		return ctx.digestChallenges(stale)
+	case scheme == "Bearer":
+		if unauthorized {
+			return []string{"Bearer " + realm + `, error="invalid_token"`}
+		}
+		return []string{"Bearer " + realm}
+	case scheme == "Basic":
+		return []string{"Basic " + realm + `, charset="UTF-8"`}
+	}
+	return []string{scheme}
+}
+
 func (ctx *Context) doConnect(w http.ResponseWriter, r *http.Request) (b bool) {
 	b = true
 	if r.Method != "CONNECT" {
@@ -188,6 +459,11 @@ func (ctx *Context) doConnect(w http.ResponseWriter, r *http.Request) (b bool) {
 		ctx.doError("Connect", ErrNotSupportHijacking, err)
 		return
 	}
+	if !ctx.Prx.hijacked.add(ctx, conn) {
+		conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"))
+		conn.Close()
+		return
+	}
 	hijConn := conn
 	ctx.ConnectReq = r
 	ctx.ConnectAction = ConnectProxy
@@ -195,6 +471,22 @@ func (ctx *Context) doConnect(w http.ResponseWriter, r *http.Request) (b bool) {
 	if !hasPort.MatchString(host) {
 		host += ":80"
 	}
+	responded := false
+	if ctx.Prx.PeekClientHello {
+		if ctx.doConnectACL(hijConn, host, false) == ConnectNone {
+			hijConn.Close()
+			return
+		}
+		if _, err := hijConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+			hijConn.Close()
+			if !isConnectionClosed(err) {
+				ctx.doError("Connect", ErrResponseWrite, err)
+			}
+			return
+		}
+		responded = true
+		ctx.peekClientHello(hijConn, clientHelloPeekTimeout)
+	}
 	if ctx.Prx.OnConnect != nil {
 		var newHost string
 		ctx.ConnectAction, newHost = ctx.onConnect(host)
@@ -206,24 +498,44 @@ func (ctx *Context) doConnect(w http.ResponseWriter, r *http.Request) (b bool) {
 		host += ":80"
 	}
 	ctx.ConnectHost = host
+	ctx.ConnectAction = ctx.doConnectACL(hijConn, host, responded)
 	switch ctx.ConnectAction {
 	case ConnectProxy:
-		conn, err := net.Dial("tcp", host)
+		conn, err := ctx.dial(host)
 		if err != nil {
-			hijConn.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
+			if !responded {
+				hijConn.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
+			}
 			hijConn.Close()
-			ctx.doError("Connect", ErrRemoteConnect, err)
+			ctx.doError("Connect", dialError(err), err)
 			return
 		}
 		remoteConn := conn.(*net.TCPConn)
-		if _, err := hijConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
-			hijConn.Close()
-			remoteConn.Close()
-			if !isConnectionClosed(err) {
-				ctx.doError("Connect", ErrResponseWrite, err)
+		if !responded {
+			if _, err := hijConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+				hijConn.Close()
+				remoteConn.Close()
+				if !isConnectionClosed(err) {
+					ctx.doError("Connect", ErrResponseWrite, err)
+				}
+				return
 			}
-			return
 		}
+		// Bytes peeked from client are replayed by reads, so they pass
+		// through the same pipeline as the rest of the tunnel.
+		clientConn := net.Conn(&prefixConn{Conn: hijConn, prefix: ctx.peekedBytes})
+		if ctx.Prx.Pcap != nil {
+			ctx.pcapStream = ctx.Prx.Pcap.NewStream(hijConn.RemoteAddr(), remoteConn.RemoteAddr())
+			clientConn = &pcapngConn{Conn: clientConn, s: ctx.pcapStream}
+		}
+		ctx.openTunnel()
+		remote := net.Conn(remoteConn)
+		if ctx.timeouts = ctx.newTunnelTimeouts(hijConn, remoteConn); ctx.timeouts != nil {
+			clientConn = &timeoutConn{Conn: clientConn, t: ctx.timeouts}
+			remote = &timeoutConn{Conn: remote, t: ctx.timeouts}
+		}
+		clientConn = ctx.quotaConn(ctx.shapeConn(clientConn, DirectionDownstream))
+		remote = ctx.quotaConn(ctx.shapeConn(remote, DirectionUpstream))
 		var wg sync.WaitGroup
 		wg.Add(2)
 		go func() {
@@ -236,14 +548,21 @@ func (ctx *Context) doConnect(w http.ResponseWriter, r *http.Request) (b bool) {
 				}
 				hijConn.Close()
 				remoteConn.Close()
-				if !isConnectionClosed(err) {
-					ctx.doError("Connect", ErrRequestRead, err)
+				if abortErr, ok := err.(*tunnelAbortError); ok {
+					ctx.doError("Connect", abortErr.kind(), abortErr.err)
+				} else {
+					ctx.doTunnelError("Connect", ErrRequestRead, err)
 				}
 			}()
-			_, err := io.Copy(remoteConn, hijConn)
+			n, err := ctx.copyTunnel(DirectionUpstream, remote, clientConn)
+			ctx.tunnel.add(DirectionUpstream, n)
+			ctx.tunnelCopyClosed(DirectionUpstream, err)
 			if err != nil {
 				panic(err)
 			}
+			if ctx.pcapStream != nil {
+				ctx.pcapStream.CloseWrite(DirectionUpstream)
+			}
 			remoteConn.CloseWrite()
 			if c, ok := hijConn.(*net.TCPConn); ok {
 				c.CloseRead()
@@ -259,14 +578,21 @@ func (ctx *Context) doConnect(w http.ResponseWriter, r *http.Request) (b bool) {
 				}
 				hijConn.Close()
 				remoteConn.Close()
-				if !isConnectionClosed(err) {
-					ctx.doError("Connect", ErrResponseWrite, err)
+				if abortErr, ok := err.(*tunnelAbortError); ok {
+					ctx.doError("Connect", abortErr.kind(), abortErr.err)
+				} else {
+					ctx.doTunnelError("Connect", ErrResponseWrite, err)
 				}
 			}()
-			_, err := io.Copy(hijConn, remoteConn)
+			n, err := ctx.copyTunnel(DirectionDownstream, clientConn, remote)
+			ctx.tunnel.add(DirectionDownstream, n)
+			ctx.tunnelCopyClosed(DirectionDownstream, err)
 			if err != nil {
 				panic(err)
 			}
+			if ctx.pcapStream != nil {
+				ctx.pcapStream.CloseWrite(DirectionDownstream)
+			}
 			remoteConn.CloseRead()
 			if c, ok := hijConn.(*net.TCPConn); ok {
 				c.CloseWrite()
@@ -275,46 +601,125 @@ func (ctx *Context) doConnect(w http.ResponseWriter, r *http.Request) (b bool) {
 		wg.Wait()
 		hijConn.Close()
 		remoteConn.Close()
+		ctx.closeTunnel()
 	case ConnectMitm:
-		tlsConfig := &tls.Config{}
 		cert := ctx.Prx.signer.SignHost(host)
 		if cert == nil {
 			hijConn.Close()
 			ctx.doError("Connect", ErrTLSSignHost, err)
 			return
 		}
-		tlsConfig.Certificates = append(tlsConfig.Certificates, *cert)
-		if _, err := hijConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
-			hijConn.Close()
-			if !isConnectionClosed(err) {
-				ctx.doError("Connect", ErrResponseWrite, err)
+		tlsConfig := ctx.mitmTLSConfig(cert)
+		if !responded {
+			if _, err := hijConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+				hijConn.Close()
+				if !isConnectionClosed(err) {
+					ctx.doError("Connect", ErrResponseWrite, err)
+				}
+				return
 			}
-			return
 		}
-		ctx.hijTLSConn = tls.Server(hijConn, tlsConfig)
+		if ctx.timeouts = ctx.newTunnelTimeouts(hijConn); ctx.timeouts != nil {
+			ctx.timeouts.setHeaderTimeout(ctx.Prx.MitmHeaderTimeout)
+		}
+		if !ctx.peeked {
+			ctx.peekClientHello(hijConn, 0)
+		}
+		// Pcap captures TLS records of client, and Wireshark decrypts them
+		// by keys written by mitmTLSConfig.
+		clientConn := net.Conn(&prefixConn{Conn: hijConn, prefix: ctx.peekedBytes})
+		if ctx.Prx.Pcap != nil {
+			var remoteAddr net.Addr
+			if addr, err := net.ResolveTCPAddr("tcp", host); err == nil {
+				remoteAddr = addr
+			}
+			ctx.pcapStream = ctx.Prx.Pcap.NewStream(hijConn.RemoteAddr(), remoteAddr)
+			clientConn = &pcapngConn{Conn: clientConn, s: ctx.pcapStream}
+		}
+		ctx.hijTLSConn = tls.Server(clientConn, tlsConfig)
 		if err := ctx.hijTLSConn.Handshake(); err != nil {
 			ctx.hijTLSConn.Close()
-			if !isConnectionClosed(err) {
-				ctx.doError("Connect", ErrTLSHandshake, err)
+			if ctx.pcapStream != nil {
+				ctx.pcapStream.Close()
 			}
+			ctx.doTunnelError("Connect", ErrTLSHandshake, err)
 			return
 		}
-		ctx.hijTLSReader = bufio.NewReader(ctx.hijTLSConn)
+		state := ctx.hijTLSConn.ConnectionState()
+		ctx.MitmClientCerts = state.PeerCertificates
+		ctx.mitmVerified = len(state.VerifiedChains) > 0
+		if len(ctx.MitmClientCerts) > 0 && ctx.Prx.OnMitmClientCert != nil {
+			if remoteCert := ctx.onMitmClientCert(ctx.MitmClientCerts); remoteCert != nil {
+				ctx.RemoteClientCert = remoteCert
+			}
+		}
+		ctx.mitmConn = ctx.hijTLSConn
+		if ctx.timeouts != nil {
+			ctx.timeouts.setHeaderTimeout(0)
+			ctx.mitmConn = &timeoutConn{Conn: ctx.mitmConn, t: ctx.timeouts}
+		}
+		ctx.openTunnel()
+		ctx.mitmConn = &countConn{Conn: ctx.mitmConn, t: ctx.tunnel}
+		ctx.hijTLSReader = bufio.NewReader(ctx.mitmConn)
 		b = false
+	case ConnectMitmSMTP, ConnectMitmIMAP, ConnectMitmPOP3:
+		remoteConn, err := ctx.dial(host)
+		if err != nil {
+			if !responded {
+				hijConn.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
+			}
+			hijConn.Close()
+			ctx.doError("Connect", dialError(err), err)
+			return
+		}
+		if !responded {
+			if _, err := hijConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+				hijConn.Close()
+				remoteConn.Close()
+				if !isConnectionClosed(err) {
+					ctx.doError("Connect", ErrResponseWrite, err)
+				}
+				return
+			}
+		}
+		ctx.openTunnel()
+		ctx.timeouts = ctx.newTunnelTimeouts(hijConn, remoteConn)
+		ctx.doStarttls(hijConn, remoteConn)
+		ctx.closeTunnel()
 	default:
 		hijConn.Close()
 	}
 	return
 }
 
+func (ctx *Context) peekClientHello(conn net.Conn, timeout time.Duration) {
+	ctx.peeked = true
+	raw, hello, err := peekClientHello(conn, timeout)
+	ctx.peekedBytes = raw
+	if hello == nil {
+		if err == errClientHelloFormat {
+			ctx.doError("Connect", ErrTLSClientHello, err)
+		}
+		return
+	}
+	ctx.ClientHello = hello
+	ctx.JA3 = hello.JA3Hash()
+	ctx.JA4 = hello.JA4()
+}
+
 func (ctx *Context) doMitm() (w http.ResponseWriter, r *http.Request) {
+	if ctx.timeouts != nil {
+		ctx.timeouts.setHeaderTimeout(ctx.Prx.MitmHeaderTimeout)
+	}
 	req, err := http.ReadRequest(ctx.hijTLSReader)
 	if err != nil {
-		if !isConnectionClosed(err) {
-			ctx.doError("Request", ErrRequestRead, err)
-		}
+		ctx.tunnelClosed(SideClient, err)
+		ctx.doTunnelError("Request", ErrRequestRead, err)
 		return
 	}
+	if ctx.timeouts != nil {
+		ctx.timeouts.setHeaderTimeout(0)
+	}
 	req.RemoteAddr = ctx.ConnectReq.RemoteAddr
 	if req.URL.IsAbs() {
 		ctx.doError("Request", ErrAbsURLAfterCONNECT, nil)
@@ -322,7 +727,13 @@ func (ctx *Context) doMitm() (w http.ResponseWriter, r *http.Request) {
 	}
 	req.URL.Scheme = "https"
 	req.URL.Host = ctx.ConnectHost
-	w = NewConnResponseWriter(ctx.hijTLSConn)
+	if h := ctx.Prx.MitmClientCertHeader; h != "" {
+		req.Header.Del(h)
+		if ctx.mitmVerified {
+			req.Header.Set(h, clientCertHeaderValue(ctx.MitmClientCerts[0]))
+		}
+	}
+	w = NewConnResponseWriter(ctx.mitmConn)
 	r = req
 	return
 }
@@ -339,6 +750,15 @@ func (ctx *Context) doRequest(w http.ResponseWriter, r *http.Request) (bool, err
 		return true, err
 	}
 	r.RequestURI = r.URL.String()
+	if h := ctx.Prx.IdentityHeader; h != "" {
+		r.Header.Del(h)
+		if ctx.AuthUser != "" && len(ctx.Prx.IdentityHeaderKey) > 0 {
+			r.Header.Set(h, ctx.identityHeaderValue(r))
+		}
+	}
+	if b, err := ctx.doRequestACL(w, r); b {
+		return true, err
+	}
 	if ctx.Prx.OnRequest == nil {
 		return false, nil
 	}
@@ -349,25 +769,44 @@ func (ctx *Context) doRequest(w http.ResponseWriter, r *http.Request) (bool, err
 	if r.Body != nil {
 		defer r.Body.Close()
 	}
+	resp.Body = ctx.quotaBody(ctx.shapeBody(resp.Body, DirectionDownstream, r.URL.Host))
 	resp.Request = r
 	resp.TransferEncoding = nil
 	if ctx.ConnectAction == ConnectMitm && ctx.Prx.MitmChunked {
 		resp.TransferEncoding = []string{"chunked"}
 	}
 	err := ServeResponse(w, resp)
-	if err != nil && !isConnectionClosed(err) {
-		ctx.doError("Request", ErrResponseWrite, err)
-	}
+	ctx.doTunnelError("Request", ErrResponseWrite, err)
 	return true, err
 }
 
+func (ctx *Context) roundTrip(r *http.Request) (*http.Response, error) {
+	rt := ctx.Prx.Rt
+	if r.URL.Scheme == "https" {
+		if ctx.RemoteClientCert == nil && ctx.Prx.ClientCerts != nil {
+			ctx.RemoteClientCert = ctx.Prx.ClientCerts.Lookup(r.URL.Host, ctx.AuthUser)
+		}
+		if tr, ok := rt.(*http.Transport); ok && ctx.RemoteClientCert != nil {
+			cert := ctx.RemoteClientCert
+			rt = ctx.Prx.certTransports.get(certKey(cert), func() *http.Transport {
+				return withClientCert(tr.Clone(), cert)
+			})
+		}
+	}
+	return rt.RoundTrip(withProxyContext(ctx, r))
+}
+
 func (ctx *Context) doResponse(w http.ResponseWriter, r *http.Request) error {
+	r.Body = ctx.quotaBody(ctx.shapeBody(r.Body, DirectionUpstream, r.URL.Host))
 	if r.Body != nil {
 		defer r.Body.Close()
 	}
-	resp, err := ctx.Prx.Rt.RoundTrip(r)
+	resp, err := ctx.roundTrip(r)
 	if err != nil {
-		if err != context.Canceled && !isConnectionClosed(err) {
+		var qerr *quotaError
+		if errors.As(err, &qerr) {
+			ctx.doError("Response", ErrQuotaExceeded, qerr)
+		} else if err != context.Canceled && !isConnectionClosed(err) {
 			ctx.doError("Response", ErrRoundTrip, err)
 		}
 		err := ServeInMemory(w, 502, nil, nil)
@@ -379,14 +818,13 @@ func (ctx *Context) doResponse(w http.ResponseWriter, r *http.Request) error {
 	if ctx.Prx.OnResponse != nil {
 		ctx.onResponse(r, resp)
 	}
+	resp.Body = ctx.quotaBody(ctx.shapeBody(resp.Body, DirectionDownstream, r.URL.Host))
 	resp.Request = r
 	resp.TransferEncoding = nil
 	if ctx.ConnectAction == ConnectMitm && ctx.Prx.MitmChunked {
 		resp.TransferEncoding = []string{"chunked"}
 	}
 	err = ServeResponse(w, resp)
-	if err != nil && !isConnectionClosed(err) {
-		ctx.doError("Response", ErrResponseWrite, err)
-	}
+	ctx.doTunnelError("Response", ErrResponseWrite, err)
 	return err
 }
@@ -0,0 +1,339 @@
+package httpproxy
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lifetime of Digest authentication nonces, if Proxy.DigestNonceLifetime
+// isn't set.
+const defaultDigestNonceLifetime = 5 * time.Minute
+
+// Digest authentication algorithms offered to clients, in order of
+// preference.
+var digestAlgorithms = []string{"SHA-256", "MD5"}
+
+// DigestHA1 returns hex encoded HA1 of Digest authentication (RFC 7616)
+// given algorithm ("MD5" or "SHA-256"), user, realm and password, to store
+// instead of password for Proxy.OnDigestAuth.
+func DigestHA1(algorithm string, user string, realm string, password string) string {
+	return digestHash(algorithm, user+":"+realm+":"+password)
+}
+
+func digestHashFunc(algorithm string) func() hash.Hash {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5", "":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+func digestHash(algorithm string, s string) string {
+	f := digestHashFunc(algorithm)
+	if f == nil {
+		return ""
+	}
+	h := f()
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Digest authentication nonce count window. A nonce count may be used out of
+// order, if it's one of the last digestNonceWindow counts.
+const digestNonceWindow = 64
+
+// Maximum number of nonces in use, to keep their nonce counts. If more
+// nonces are used, the oldest ones are evicted.
+const digestMaxNonces = 1 << 16
+
+// digestNonce keeps nonce counts of a nonce in use.
+type digestNonce struct {
+	expires time.Time
+
+	// The highest nonce count, and bits of nonce counts used in window
+	// ending at nc, bit i for count nc-i.
+	nc     uint64
+	window uint64
+}
+
+// digestNonces issues stateless nonces, signed by HMAC with their issue
+// time, and keeps nonce counts of nonces in use to reject replays. Only
+// nonces of verified credentials are kept, up to digestMaxNonces; the oldest
+// ones are evicted beyond that, and nonces expiring before the evicted ones
+// are stale since their counts are lost.
+type digestNonces struct {
+	mu        sync.Mutex
+	key       []byte
+	nonces    map[string]*digestNonce
+	order     []string
+	evicted   time.Time
+	nextSweep time.Time
+}
+
+// sign returns HMAC of nonce data.
+func (n *digestNonces) sign(data []byte) []byte {
+	n.mu.Lock()
+	if n.key == nil {
+		n.key = make([]byte, 32)
+		if _, err := rand.Read(n.key); err != nil {
+			panic(err)
+		}
+	}
+	key := n.key
+	n.mu.Unlock()
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)[:16]
+}
+
+// issue returns a new nonce. It keeps no state.
+func (n *digestNonces) issue() string {
+	b := make([]byte, 16, 32)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	if _, err := rand.Read(b[8:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(append(b, n.sign(b)...))
+}
+
+// check checks nonce is issued by proxy, and returns its expiration time
+// given lifetime. If nonce isn't issued by proxy, ok is false; it may be
+// expired otherwise.
+func (n *digestNonces) check(nonce string, lifetime time.Duration) (expires time.Time, ok bool) {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 32 || !hmac.Equal(b[16:], n.sign(b[:16])) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b))).Add(lifetime), true
+}
+
+// sweep removes expired nonces, and compacts eviction order of nonces.
+func (n *digestNonces) sweep(now time.Time) {
+	if now.Before(n.nextSweep) {
+		return
+	}
+	n.nextSweep = now.Add(time.Minute)
+	order := make([]string, 0, len(n.nonces))
+	for _, k := range n.order {
+		if v, ok := n.nonces[k]; ok && now.After(v.expires) {
+			delete(n.nonces, k)
+		} else if ok {
+			order = append(order, k)
+		}
+	}
+	n.order = order
+}
+
+// evict removes the oldest nonce in use.
+func (n *digestNonces) evict() {
+	for len(n.order) > 0 {
+		k := n.order[0]
+		n.order = n.order[1:]
+		if v, ok := n.nonces[k]; ok {
+			delete(n.nonces, k)
+			if v.expires.After(n.evicted) {
+				n.evicted = v.expires
+			}
+			return
+		}
+	}
+}
+
+// use checks nonce count nc of nonce isn't used before, and records it. If
+// nonce expires before an evicted one and isn't in use, its counts may be
+// lost, and stale is true.
+func (n *digestNonces) use(nonce string, nc uint64, expires time.Time) (ok bool, stale bool) {
+	if nc == 0 {
+		return false, false
+	}
+	now := time.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.nonces == nil {
+		n.nonces = make(map[string]*digestNonce)
+	}
+	n.sweep(now)
+	v := n.nonces[nonce]
+	if v == nil {
+		if !expires.After(n.evicted) {
+			return false, true
+		}
+		if len(n.nonces) >= digestMaxNonces {
+			n.evict()
+		}
+		v = &digestNonce{expires: expires}
+		n.nonces[nonce] = v
+		n.order = append(n.order, nonce)
+	}
+	switch {
+	case nc > v.nc:
+		if shift := nc - v.nc; shift < digestNonceWindow {
+			v.window = v.window<<shift | 1
+		} else {
+			v.window = 1
+		}
+		v.nc = nc
+	case v.nc-nc < digestNonceWindow && v.window&(1<<(v.nc-nc)) == 0:
+		v.window |= 1 << (v.nc - nc)
+	default:
+		return false, false
+	}
+	return true, false
+}
+
+// digestResponse returns request-digest of credentials given HA1.
+func digestResponse(algorithm string, ha1 string, nonce string, nc string, cnonce string, qop string, method string, uri string) string {
+	ha2 := digestHash(algorithm, method+":"+uri)
+	return digestHash(algorithm, ha1+":"+nonce+":"+nc+":"+cnonce+":"+qop+":"+ha2)
+}
+
+// digestURIMatch checks digest-uri of credentials is request target of r,
+// in the form of request line, origin form or absolute form.
+func digestURIMatch(uri string, r *http.Request) bool {
+	if uri == r.RequestURI {
+		return true
+	}
+	if r.Method == "CONNECT" {
+		return uri == r.URL.Host
+	}
+	if uri == r.URL.RequestURI() {
+		return true
+	}
+	u, err := url.Parse(uri)
+	return err == nil && u.IsAbs() && strings.EqualFold(u.Scheme, r.URL.Scheme) &&
+		strings.EqualFold(u.Host, r.URL.Host) && u.RequestURI() == r.URL.RequestURI()
+}
+
+// parseAuthParams parses comma separated auth-params of an authorization
+// header.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+		i := strings.IndexAny(s, "=, \t")
+		if i < 0 || s[i] != '=' {
+			return params
+		}
+		key := strings.ToLower(s[:i])
+		s = strings.TrimLeft(s[i+1:], " \t")
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i = 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			value = b.String()
+			if i < len(s) {
+				i++
+			}
+		} else {
+			i = strings.IndexAny(s, ", \t")
+			if i < 0 {
+				i = len(s)
+			}
+			value = s[:i]
+		}
+		params[key] = value
+		s = s[i:]
+	}
+}
+
+func (ctx *Context) onDigestAuth(user string, realm string, algorithm string) (ha1 string, ok bool) {
+	defer func() {
+		if err, ok2 := recover().(error); ok2 {
+			ctx.doError("Auth", ErrPanic, err)
+			ha1, ok = "", false
+		}
+	}()
+	return ctx.Prx.OnDigestAuth(ctx, user, realm, algorithm)
+}
+
+func (ctx *Context) authRealm() string {
+	if ctx.Prx.AuthRealm != "" {
+		return ctx.Prx.AuthRealm
+	}
+	return "httpproxy"
+}
+
+// digestChallenges returns Proxy-Authenticate header values of Digest
+// authentication, one for each algorithm.
+func (ctx *Context) digestChallenges(stale bool) []string {
+	var challenges []string
+	for _, alg := range digestAlgorithms {
+		c := `Digest realm="` + strings.ReplaceAll(ctx.authRealm(), `"`, `\"`) + `", qop="auth", algorithm=` +
+			alg + `, nonce="` + ctx.Prx.digestNonces.issue() + `"`
+		if stale {
+			c += ", stale=true"
+		}
+		challenges = append(challenges, c)
+	}
+	return challenges
+}
+
+// doDigestAuth verifies Digest credentials of request. If credentials are
+// valid but their nonce issued by proxy is expired, stale is true.
+func (ctx *Context) doDigestAuth(r *http.Request, data string) (ok bool, stale bool) {
+	p := parseAuthParams(data)
+	user, realm, nonce, uri := p["username"], p["realm"], p["nonce"], p["uri"]
+	alg, qop, cnonce := p["algorithm"], p["qop"], p["cnonce"]
+	alg = strings.ToUpper(alg)
+	if alg == "" {
+		alg = "MD5"
+	}
+	if user == "" || realm != ctx.authRealm() || qop != "auth" || cnonce == "" ||
+		!digestURIMatch(uri, r) || digestHashFunc(alg) == nil {
+		return false, false
+	}
+	nc, err := strconv.ParseUint(p["nc"], 16, 64)
+	if err != nil {
+		return false, false
+	}
+	lifetime := ctx.Prx.DigestNonceLifetime
+	if lifetime <= 0 {
+		lifetime = defaultDigestNonceLifetime
+	}
+	expires, issued := ctx.Prx.digestNonces.check(nonce, lifetime)
+	if !issued {
+		return false, false
+	}
+	ha1, found := ctx.onDigestAuth(user, realm, strings.TrimSuffix(alg, "-SESS"))
+	if !found {
+		return false, false
+	}
+	if strings.HasSuffix(alg, "-SESS") {
+		ha1 = digestHash(alg, ha1+":"+nonce+":"+cnonce)
+	}
+	expected := digestResponse(alg, ha1, nonce, p["nc"], cnonce, qop, r.Method, uri)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(p["response"]))) != 1 {
+		return false, false
+	}
+	if !time.Now().Before(expires) {
+		return false, true
+	}
+	if ok, stale := ctx.Prx.digestNonces.use(nonce, nc, expires); !ok {
+		return false, stale
+	}
+	ctx.AuthUser = user
+	return true, false
+}
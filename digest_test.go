@@ -0,0 +1,154 @@
+package httpproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDigestResponse(t *testing.T) {
+	// Known answers of RFC 7616 3.9.1.
+	const (
+		nonce  = "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"
+		cnonce = "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+	)
+	tests := []struct {
+		algorithm string
+		want      string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, tt := range tests {
+		ha1 := DigestHA1(tt.algorithm, "Mufasa", "http-auth@example.org", "Circle of Life")
+		if got := digestResponse(tt.algorithm, ha1, nonce, "00000001", cnonce, "auth", "GET", "/dir/index.html"); got != tt.want {
+			t.Errorf("%s: response %s, want %s", tt.algorithm, got, tt.want)
+		}
+	}
+	// HA1 of RFC 2617 3.5.
+	if got, want := DigestHA1("MD5", "Mufasa", "testrealm@host.com", "Circle Of Life"), "939e7578ed9e3c518a452acee763bce9"; got != want {
+		t.Errorf("HA1 %s, want %s", got, want)
+	}
+}
+
+// newTestDigestContext returns a Context of proxy authenticating user Mufasa
+// by Digest authentication.
+func newTestDigestContext(t *testing.T) *Context {
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prx.OnDigestAuth = func(ctx *Context, user string, realm string, algorithm string) (string, bool) {
+		return DigestHA1(algorithm, user, realm, "Circle of Life"), user == "Mufasa"
+	}
+	return &Context{Prx: prx}
+}
+
+// testDigestAuth verifies Digest credentials of request to uri given nonce,
+// nonce count and password.
+func testDigestAuth(ctx *Context, algorithm string, nonce string, nc uint64, pass string) (ok bool, stale bool) {
+	const uri = "/dir/index.html"
+	realm, ncStr := ctx.authRealm(), fmt.Sprintf("%08x", nc)
+	ha1 := DigestHA1(algorithm, "Mufasa", realm, pass)
+	response := digestResponse(algorithm, ha1, nonce, ncStr, "cnonce", "auth", "GET", uri)
+	data := fmt.Sprintf(`username="Mufasa", realm="%s", nonce="%s", uri="%s", algorithm=%s, qop=auth, nc=%s, cnonce="cnonce", response="%s"`,
+		realm, nonce, uri, algorithm, ncStr, response)
+	return ctx.doDigestAuth(httptest.NewRequest("GET", uri, nil), data)
+}
+
+func TestDigestAuthNonceCount(t *testing.T) {
+	for _, alg := range digestAlgorithms {
+		ctx := newTestDigestContext(t)
+		nonce := ctx.Prx.digestNonces.issue()
+		steps := []struct {
+			nc   uint64
+			want bool
+		}{
+			{1, true},
+			{1, false}, // replay
+			{3, true},
+			{2, true}, // out of order in window
+			{2, false},
+			{0, false},
+			{3 + digestNonceWindow - 1, true},
+			{3, false},
+			{4, true}, // unused count in window
+			{2 * digestNonceWindow, true},
+			{digestNonceWindow + 1, true}, // the oldest count in window
+			{digestNonceWindow, false},    // unused count out of window
+			{2 * digestNonceWindow, false},
+		}
+		for _, s := range steps {
+			if ok, stale := testDigestAuth(ctx, alg, nonce, s.nc, "Circle of Life"); ok != s.want || stale {
+				t.Errorf("%s: nc %d: ok %v, stale %v, want %v", alg, s.nc, ok, stale, s.want)
+			}
+		}
+		if ok, stale := testDigestAuth(ctx, alg, nonce, 1000, "wrong"); ok || stale {
+			t.Errorf("%s: wrong password: ok %v, stale %v", alg, ok, stale)
+		}
+		if ctx.AuthUser != "Mufasa" {
+			t.Errorf("%s: AuthUser %q", alg, ctx.AuthUser)
+		}
+	}
+}
+
+func TestDigestAuthNonceExpiry(t *testing.T) {
+	ctx := newTestDigestContext(t)
+
+	// Nonce not issued by proxy is never stale.
+	b := make([]byte, 32)
+	rand.Read(b)
+	if ok, stale := testDigestAuth(ctx, "MD5", hex.EncodeToString(b), 1, "Circle of Life"); ok || stale {
+		t.Errorf("forged nonce: ok %v, stale %v", ok, stale)
+	}
+	if ok, stale := testDigestAuth(ctx, "MD5", "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", 1, "Circle of Life"); ok || stale {
+		t.Errorf("malformed nonce: ok %v, stale %v", ok, stale)
+	}
+
+	// Expired nonce is stale only with valid credentials.
+	nonce := ctx.Prx.digestNonces.issue()
+	ctx.Prx.DigestNonceLifetime = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	if ok, stale := testDigestAuth(ctx, "MD5", nonce, 1, "wrong"); ok || stale {
+		t.Errorf("expired nonce, wrong password: ok %v, stale %v", ok, stale)
+	}
+	if ok, stale := testDigestAuth(ctx, "MD5", nonce, 1, "Circle of Life"); ok || !stale {
+		t.Errorf("expired nonce: ok %v, stale %v, want stale", ok, stale)
+	}
+	ctx.Prx.DigestNonceLifetime = time.Minute
+	if ok, stale := testDigestAuth(ctx, "MD5", nonce, 1, "Circle of Life"); !ok || stale {
+		t.Errorf("nonce in lifetime: ok %v, stale %v", ok, stale)
+	}
+}
+
+func TestDigestNoncesEviction(t *testing.T) {
+	var n digestNonces
+	expires := time.Now().Add(time.Minute)
+	for i := 0; i < digestMaxNonces; i++ {
+		if ok, stale := n.use(fmt.Sprint(i), 1, expires.Add(time.Duration(i))); !ok || stale {
+			t.Fatalf("nonce %d: ok %v, stale %v", i, ok, stale)
+		}
+	}
+	// New nonces evict the oldest ones instead of being refused.
+	for i := digestMaxNonces; i < digestMaxNonces+10; i++ {
+		if ok, stale := n.use(fmt.Sprint(i), 1, expires.Add(time.Duration(i))); !ok || stale {
+			t.Fatalf("nonce %d beyond capacity: ok %v, stale %v", i, ok, stale)
+		}
+	}
+	if len(n.nonces) != digestMaxNonces {
+		t.Errorf("%d nonces, want %d", len(n.nonces), digestMaxNonces)
+	}
+	// Counts of evicted nonces are lost, so they can't be replayed.
+	if ok, stale := n.use("0", 1, expires); ok || !stale {
+		t.Errorf("evicted nonce: ok %v, stale %v, want stale", ok, stale)
+	}
+	if ok, stale := n.use("10", 2, expires.Add(10)); !ok || stale {
+		t.Errorf("kept nonce: ok %v, stale %v", ok, stale)
+	}
+	if ok, stale := n.use("10", 1, expires.Add(10)); ok || stale {
+		t.Errorf("kept nonce replay: ok %v, stale %v", ok, stale)
+	}
+}
@@ -1,6 +1,7 @@
 package httpproxy
 
 import (
+	"errors"
 	"io"
 	"net"
 	"os"
@@ -13,13 +14,29 @@ var (
 	ErrResponseWrite               = NewError("response write")
 	ErrRequestRead                 = NewError("request read")
 	ErrRemoteConnect               = NewError("remote connect")
+	ErrDialTimeout                 = NewError("dial timeout")
+	ErrIdleTimeout                 = NewError("idle timeout")
+	ErrHeaderTimeout               = NewError("request header timeout")
+	ErrLifetimeExceeded            = NewError("tunnel lifetime exceeded")
+	ErrTunnelAborted               = NewError("tunnel aborted")
 	ErrNotSupportHijacking         = NewError("hijacking not supported")
+	ErrAuthScheme                  = NewError("auth scheme")
+	ErrConnAuth                    = NewError("connection auth")
+	ErrBearerAuth                  = NewError("bearer auth")
+	ErrAuthFile                    = NewError("auth file")
+	ErrLDAP                        = NewError("LDAP")
+	ErrAuthThrottled               = NewError("auth throttled")
+	ErrACLDenied                   = NewError("ACL denied")
 	ErrTLSSignHost                 = NewError("TLS sign host")
 	ErrTLSHandshake                = NewError("TLS handshake")
+	ErrTLSClientHello              = NewError("TLS ClientHello")
 	ErrAbsURLAfterCONNECT          = NewError("absolute URL after CONNECT")
 	ErrRoundTrip                   = NewError("round trip")
 	ErrUnsupportedTransferEncoding = NewError("unsupported transfer encoding")
 	ErrNotSupportHTTPVer           = NewError("http version not supported")
+	ErrLimitExceeded               = NewError("limit exceeded")
+	ErrQuotaExceeded               = NewError("quota exceeded")
+	ErrQuotaSave                   = NewError("quota save")
 )
 
 // Error struct is base of library specific errors.
@@ -41,7 +58,7 @@ func isConnectionClosed(err error) bool {
 	if err == nil {
 		return false
 	}
-	if err == io.EOF {
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
 		return true
 	}
 	i := 0
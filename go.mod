@@ -0,0 +1,8 @@
+module github.com/go-httpproxy/httpproxy
+
+go 1.20
+
+require (
+	golang.org/x/crypto v0.31.0
+	software.sslmate.com/src/go-pkcs12 v0.5.0
+)
@@ -0,0 +1,272 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Interval of checking htpasswd file changes, if
+// HtpasswdFile.ReloadInterval isn't set.
+const defaultHtpasswdReloadInterval = 5 * time.Second
+
+// htpasswdEntry is a user entry of htpasswd file.
+type htpasswdEntry struct {
+	// Password hash of htpasswd line "user:hash".
+	hash string
+
+	// Realm and HA1 of htdigest line "user:realm:ha1".
+	realm string
+	ha1   string
+}
+
+// HtpasswdFile authenticates users by an Apache htpasswd file. It supports
+// bcrypt ($2y$), SHA ({SHA}), APR1 ($apr1$) and MD5-crypt ($1$) hashes, and
+// plaintext passwords if AllowPlaintext is true. crypt(3) DES hashes aren't
+// supported, and their users are rejected. Lines of htdigest format
+// "user:realm:ha1" are accepted too, for Digest authentication with MD5
+// algorithm. The file is reloaded when it changes, and the previous users
+// stay if it's invalid. It's safe for concurrent use.
+type HtpasswdFile struct {
+	// Path of the file.
+	Path string
+
+	// Interval of checking the file changes.
+	// By default, 5 seconds.
+	ReloadInterval time.Duration
+
+	// Accepts entries without a known hash prefix as plaintext passwords,
+	// like Apache htpasswd -p. Otherwise they are taken as crypt(3) DES
+	// hashes, like Apache does, and rejected.
+	// By default, false.
+	AllowPlaintext bool
+
+	mu      sync.Mutex
+	entries map[string]htpasswdEntry
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// NewHtpasswdFile returns a new HtpasswdFile given file path, and loads the
+// file.
+func NewHtpasswdFile(path string) (*HtpasswdFile, error) {
+	h := &HtpasswdFile{Path: path}
+	if err := h.reload(true); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// reload loads the file if it changed since the last load, or force is
+// true.
+func (h *HtpasswdFile) reload(force bool) error {
+	interval := h.ReloadInterval
+	if interval <= 0 {
+		interval = defaultHtpasswdReloadInterval
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if !force && now.Sub(h.checked) < interval {
+		return nil
+	}
+	h.checked = now
+	fi, err := os.Stat(h.Path)
+	if err != nil {
+		return err
+	}
+	if !force && fi.ModTime().Equal(h.modTime) && fi.Size() == h.size {
+		return nil
+	}
+	data, err := ioutil.ReadFile(h.Path)
+	if err != nil {
+		return err
+	}
+	entries, err := parseHtpasswd(data)
+	if err != nil {
+		return err
+	}
+	h.entries, h.modTime, h.size = entries, fi.ModTime(), fi.Size()
+	return nil
+}
+
+func parseHtpasswd(data []byte) (map[string]htpasswdEntry, error) {
+	entries := make(map[string]htpasswdEntry)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		user, hash := fields[0], fields[1]
+		if i := strings.LastIndexByte(hash, ':'); i >= 0 && !htpasswdHashed(hash) && isHA1(hash[i+1:]) {
+			entries[user] = htpasswdEntry{realm: hash[:i], ha1: strings.ToLower(hash[i+1:])}
+			continue
+		}
+		entries[user] = htpasswdEntry{hash: hash}
+	}
+	return entries, scanner.Err()
+}
+
+func (h *HtpasswdFile) entry(ctx *Context, user string) (htpasswdEntry, bool) {
+	if err := h.reload(false); err != nil && ctx != nil {
+		ctx.doError("Auth", ErrAuthFile, err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.entries[user]
+	return e, ok
+}
+
+// Verify checks password of user.
+func (h *HtpasswdFile) Verify(user string, pass string) bool {
+	e, ok := h.entry(nil, user)
+	return ok && e.hash != "" && htpasswdMatch(e.hash, pass, h.AllowPlaintext)
+}
+
+// Auth checks password of user. Set it to Proxy.OnAuth.
+func (h *HtpasswdFile) Auth(ctx *Context, authType string, user string, pass string) bool {
+	e, ok := h.entry(ctx, user)
+	return ok && e.hash != "" && htpasswdMatch(e.hash, pass, h.AllowPlaintext)
+}
+
+// DigestAuth returns HA1 of user. Set it to Proxy.OnDigestAuth. Only users
+// with htdigest lines of realm, or plaintext passwords if AllowPlaintext is
+// true, are found; htdigest lines work only with MD5 algorithm.
+func (h *HtpasswdFile) DigestAuth(ctx *Context, user string, realm string, algorithm string) (ha1 string, ok bool) {
+	e, ok := h.entry(ctx, user)
+	if !ok {
+		return "", false
+	}
+	if e.ha1 != "" {
+		if e.realm != realm || algorithm != "MD5" {
+			return "", false
+		}
+		return e.ha1, true
+	}
+	if !h.AllowPlaintext || htpasswdHashed(e.hash) {
+		return "", false
+	}
+	return DigestHA1(algorithm, user, realm, e.hash), true
+}
+
+// htpasswdHashed checks hash has a known hash prefix.
+func htpasswdHashed(hash string) bool {
+	return strings.HasPrefix(hash, "$") || strings.HasPrefix(hash, "{SHA}")
+}
+
+// isHA1 checks s is an MD5 HA1 of htdigest line, 32 hex digits.
+func isHA1(s string) bool {
+	if len(s) != 2*md5.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// htpasswdMatch checks pass matches hash of htpasswd line. Hash without a
+// known prefix is a plaintext password if plaintext is true, otherwise it
+// never matches.
+func htpasswdMatch(hash string, pass string, plaintext bool) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		magic := hash[:strings.Index(hash[1:], "$")+2]
+		salt := hash[len(magic):]
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(md5Crypt(pass, salt, magic))) == 1
+	case htpasswdHashed(hash), !plaintext:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(pass)) == 1
+}
+
+// md5Crypt returns MD5-crypt hash of password given salt and magic, "$1$" or
+// "$apr1$".
+func md5Crypt(pass string, salt string, magic string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(pass)
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var b strings.Builder
+	b.WriteString(magic + salt + "$")
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(sum[i[0]])<<16|uint32(sum[i[1]])<<8|uint32(sum[i[2]]), 4)
+	}
+	to64(uint32(sum[11]), 2)
+	return b.String()
+}
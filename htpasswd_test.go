@@ -0,0 +1,137 @@
+package httpproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHtpasswdMatch(t *testing.T) {
+	tests := []struct {
+		hash      string
+		pass      string
+		plaintext bool
+		want      bool
+	}{
+		// OpenBSD bcrypt test vector.
+		{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U", false, true},
+		{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*V", false, false},
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password", false, true},
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "Password", false, false},
+		// openssl passwd -apr1 -salt rKgAiHh8 myPassword
+		{"$apr1$rKgAiHh8$HpkIfwRAiZUDu5NZZTO/x0", "myPassword", false, true},
+		{"$apr1$rKgAiHh8$HpkIfwRAiZUDu5NZZTO/x0", "mypassword", false, false},
+		// openssl passwd -1 -salt saltsalt password
+		{"$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/", "password", false, true},
+		{"$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/", "passwore", false, false},
+		{"secret", "secret", true, true},
+		{"secret", "secret", false, false},
+		// crypt(3) DES of "secret" is never accepted.
+		{"abJnggxhB/yLI", "secret", false, false},
+		{"$5$rounds=5000$salt$hash", "", true, false},
+	}
+	for _, tt := range tests {
+		if got := htpasswdMatch(tt.hash, tt.pass, tt.plaintext); got != tt.want {
+			t.Errorf("htpasswdMatch(%q, %q, %v) = %v, want %v", tt.hash, tt.pass, tt.plaintext, got, tt.want)
+		}
+	}
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	entries, err := parseHtpasswd([]byte(`# comment
+
+alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+Mufasa:testrealm@host.com:939e7578ed9e3c518a452acee763bce9
+bob:realm:with:colons:939E7578ED9E3C518A452ACEE763BCE9
+carol:plain:text
+invalid line
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]htpasswdEntry{
+		"alice":  {hash: "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="},
+		"Mufasa": {realm: "testrealm@host.com", ha1: "939e7578ed9e3c518a452acee763bce9"},
+		"bob":    {realm: "realm:with:colons", ha1: "939e7578ed9e3c518a452acee763bce9"},
+		"carol":  {hash: "plain:text"},
+	}
+	if len(entries) != len(want) {
+		t.Errorf("entries = %v, want %v", entries, want)
+	}
+	for user, e := range want {
+		if entries[user] != e {
+			t.Errorf("entry of %s = %+v, want %+v", user, entries[user], e)
+		}
+	}
+}
+
+func TestHtpasswdFileDigestAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htdigest")
+	data := "Mufasa:testrealm@host.com:939e7578ed9e3c518a452acee763bce9\nalice:secret\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// HA1 of RFC 2617 example.
+	if ha1, ok := h.DigestAuth(nil, "Mufasa", "testrealm@host.com", "MD5"); !ok || ha1 != "939e7578ed9e3c518a452acee763bce9" {
+		t.Errorf("htdigest user: %q, %v", ha1, ok)
+	}
+	if _, ok := h.DigestAuth(nil, "Mufasa", "other", "MD5"); ok {
+		t.Error("htdigest user found in other realm")
+	}
+	if _, ok := h.DigestAuth(nil, "Mufasa", "testrealm@host.com", "SHA-256"); ok {
+		t.Error("htdigest user found with SHA-256")
+	}
+	if _, ok := h.DigestAuth(nil, "alice", "realm", "MD5"); ok {
+		t.Error("plaintext user found without AllowPlaintext")
+	}
+	h.AllowPlaintext = true
+	if ha1, ok := h.DigestAuth(nil, "alice", "realm", "MD5"); !ok || ha1 != DigestHA1("MD5", "alice", "realm", "secret") {
+		t.Errorf("plaintext user: %q, %v", ha1, ok)
+	}
+	if h.Verify("Mufasa", "Circle Of Life") {
+		t.Error("htdigest user verified by Basic password")
+	}
+}
+
+func TestHtpasswdFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := ioutil.WriteFile(path, []byte("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ReloadInterval = time.Nanosecond
+	if !h.Verify("alice", "password") || h.Verify("bob", "password") {
+		t.Fatal("initial users aren't loaded")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Minute)
+	os.Chtimes(path, mtime, mtime)
+	if h.Verify("alice", "password") || !h.Verify("bob", "password") {
+		t.Error("users aren't reloaded on mtime change")
+	}
+
+	// Users stay while the file is unreadable.
+	os.Remove(path)
+	if !h.Verify("bob", "password") {
+		t.Error("users are dropped on missing file")
+	}
+
+	// The file isn't checked again within ReloadInterval.
+	h.ReloadInterval = time.Hour
+	ioutil.WriteFile(path, []byte("carol:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600)
+	if h.Verify("carol", "password") || !h.Verify("bob", "password") {
+		t.Error("file is reloaded within ReloadInterval")
+	}
+}
@@ -23,6 +23,30 @@ const (
 	// ConnectMitm specifies proxy "Man in the Middle" style attack
 	// after the CONNECT.
 	ConnectMitm
+
+	// ConnectMitmSMTP specifies proxy SMTP in plaintext, and "Man in the
+	// Middle" style attack after the STARTTLS command.
+	ConnectMitmSMTP
+
+	// ConnectMitmIMAP specifies proxy IMAP in plaintext, and "Man in the
+	// Middle" style attack after the STARTTLS command.
+	ConnectMitmIMAP
+
+	// ConnectMitmPOP3 specifies proxy POP3 in plaintext, and "Man in the
+	// Middle" style attack after the STLS command.
+	ConnectMitmPOP3
+)
+
+// Direction specifies direction of proxied data.
+type Direction int
+
+// Constants of Direction type.
+const (
+	// DirectionUpstream specifies data sent from client to remote.
+	DirectionUpstream = Direction(iota)
+
+	// DirectionDownstream specifies data sent from remote to client.
+	DirectionDownstream
 )
 
 // DefaultCaCert provides default CA certificate.
@@ -0,0 +1,126 @@
+package httpproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors of identity header verification.
+var (
+	errIdentityMissing   = errors.New("identity header missing")
+	errIdentityFormat    = errors.New("malformed identity header")
+	errIdentitySignature = errors.New("invalid identity header signature")
+	errIdentityHost      = errors.New("identity header host mismatch")
+	errIdentityExpired   = errors.New("identity header expired")
+)
+
+// Identity is an authenticated identity of proxy client forwarded to remote
+// by Proxy.IdentityHeader.
+type Identity struct {
+	User   string
+	Groups []string
+	Scheme string
+
+	// Time of signing by proxy.
+	Time time.Time
+}
+
+// identityHost returns host of request without port.
+func identityHost(r *http.Request) string {
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func identitySign(key []byte, payload string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// identityHeaderValue returns value of Proxy.IdentityHeader for remote
+// request r. It's signed with host of r, so it can't be replayed to other
+// hosts.
+func (ctx *Context) identityHeaderValue(r *http.Request) string {
+	groups := make([]string, len(ctx.AuthGroups))
+	for i, g := range ctx.AuthGroups {
+		groups[i] = url.QueryEscape(g)
+	}
+	payload := "user=" + url.QueryEscape(ctx.AuthUser) +
+		";groups=" + strings.Join(groups, ",") +
+		";scheme=" + url.QueryEscape(ctx.AuthScheme) +
+		";host=" + url.QueryEscape(identityHost(r)) +
+		";ts=" + strconv.FormatInt(time.Now().Unix(), 10)
+	return payload + ";sig=" + identitySign(ctx.Prx.IdentityHeaderKey, payload)
+}
+
+// VerifyIdentityHeader verifies identity header forwarded by proxy in request
+// received by remote service, given header name and key of
+// Proxy.IdentityHeader and Proxy.IdentityHeaderKey. The header must be
+// signed for host of request within maxAge.
+func VerifyIdentityHeader(r *http.Request, name string, key []byte, maxAge time.Duration) (*Identity, error) {
+	v := r.Header.Get(name)
+	if v == "" {
+		return nil, errIdentityMissing
+	}
+	i := strings.LastIndex(v, ";sig=")
+	if i < 0 {
+		return nil, errIdentityFormat
+	}
+	payload, sig := v[:i], v[i+len(";sig="):]
+	if !hmac.Equal([]byte(sig), []byte(identitySign(key, payload))) {
+		return nil, errIdentitySignature
+	}
+	fields := make(map[string]string)
+	for _, kv := range strings.Split(payload, ";") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, errIdentityFormat
+		}
+		fields[parts[0]] = parts[1]
+	}
+	host, err := url.QueryUnescape(fields["host"])
+	if err != nil {
+		return nil, errIdentityFormat
+	}
+	if host != identityHost(r) {
+		return nil, errIdentityHost
+	}
+	ts, err := strconv.ParseInt(fields["ts"], 10, 64)
+	if err != nil {
+		return nil, errIdentityFormat
+	}
+	id := &Identity{Time: time.Unix(ts, 0)}
+	if age := time.Since(id.Time); age > maxAge || age < -maxAge {
+		return nil, errIdentityExpired
+	}
+	if id.User, err = url.QueryUnescape(fields["user"]); err != nil {
+		return nil, errIdentityFormat
+	}
+	if id.Scheme, err = url.QueryUnescape(fields["scheme"]); err != nil {
+		return nil, errIdentityFormat
+	}
+	if fields["groups"] != "" {
+		for _, g := range strings.Split(fields["groups"], ",") {
+			group, err := url.QueryUnescape(g)
+			if err != nil {
+				return nil, errIdentityFormat
+			}
+			id.Groups = append(id.Groups, group)
+		}
+	}
+	return id, nil
+}
@@ -0,0 +1,402 @@
+package httpproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimum interval of reloading JWKS to find an unknown key ID.
+const jwksMinReloadInterval = time.Minute
+
+// Errors of JWT verification.
+var (
+	errJWTFormat    = errors.New("malformed JWT")
+	errJWTAlgorithm = errors.New("unsupported JWT algorithm")
+	errJWTKey       = errors.New("JWT signing key not found")
+	errJWTSignature = errors.New("invalid JWT signature")
+	errJWTExpired   = errors.New("JWT expired")
+	errJWTNoExp     = errors.New("JWT has no expiration")
+	errJWTNoUser    = errors.New("JWT has no user claim")
+	errJWTNotYet    = errors.New("JWT not valid yet")
+	errJWTAudience  = errors.New("JWT audience mismatch")
+	errJWTIssuer    = errors.New("JWT issuer mismatch")
+	errJWTCritical  = errors.New("unsupported JWT critical header")
+)
+
+// JWTVerifier verifies JWTs sent by Bearer authentication (RFC 6750) by keys
+// of a JWKS. It supports RS, PS, ES, EdDSA and HS algorithms. Tokens must
+// have exp and user claims, and no crit header, since no extension is
+// understood. It's safe for concurrent use.
+type JWTVerifier struct {
+	// JWKS source, a file path or an http(s) URL.
+	JWKS string
+
+	// Expected audience. If it's "", audience isn't checked.
+	Audience string
+
+	// Expected issuer. If it's "", issuer isn't checked.
+	Issuer string
+
+	// Allowed clock skew of exp and nbf checks.
+	// By default, 0.
+	Leeway time.Duration
+
+	// Interval of reloading JWKS. JWKS is reloaded for an unknown key ID
+	// too, but at most once per minute.
+	// By default, 10 minutes.
+	RefreshInterval time.Duration
+
+	// Claim of user name set to ctx.AuthUser.
+	// By default, "sub".
+	UserClaim string
+
+	mu      sync.Mutex
+	keys    map[string]interface{}
+	loaded  time.Time
+	tried   time.Time
+	loading chan struct{}
+	loadErr error
+}
+
+// NewJWTVerifier returns a new JWTVerifier given JWKS file path or URL, and
+// loads JWKS.
+func NewJWTVerifier(jwks string) (*JWTVerifier, error) {
+	v := &JWTVerifier{JWKS: jwks, tried: time.Now()}
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// load loads keys from JWKS source.
+func (v *JWTVerifier) load() error {
+	var data []byte
+	var err error
+	if strings.HasPrefix(v.JWKS, "http://") || strings.HasPrefix(v.JWKS, "https://") {
+		client := &http.Client{Timeout: 10 * time.Second}
+		var resp *http.Response
+		if resp, err = client.Get(v.JWKS); err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("JWKS %s: %s", v.JWKS, resp.Status)
+		}
+		data, err = ioutil.ReadAll(resp.Body)
+	} else {
+		data, err = ioutil.ReadFile(v.JWKS)
+	}
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("JWK %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	v.mu.Lock()
+	v.keys, v.loaded = keys, time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+func (k *jwk) publicKey() (interface{}, error) {
+	b64 := func(s string) []byte {
+		b, _ := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		return b
+	}
+	switch k.Kty {
+	case "RSA":
+		n, e := b64(k.N), b64(k.E)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(b64(k.X)), Y: new(big.Int).SetBytes(b64(k.Y))}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return pub, nil
+	case "OKP":
+		x := b64(k.X)
+		if k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		key := b64(k.K)
+		if len(key) == 0 {
+			return nil, errors.New("invalid oct key")
+		}
+		return key, nil
+	}
+	return nil, errors.New("unsupported key type " + k.Kty)
+}
+
+// key returns key given key ID. It reloads JWKS if it's stale or key ID is
+// unknown, at most once per jwksMinReloadInterval. Concurrent callers share
+// one reload.
+func (v *JWTVerifier) key(kid string) (interface{}, error) {
+	refresh := v.RefreshInterval
+	if refresh <= 0 {
+		refresh = 10 * time.Minute
+	}
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	if (!ok || time.Since(v.loaded) > refresh) && v.loading == nil && time.Since(v.tried) >= jwksMinReloadInterval {
+		loading := make(chan struct{})
+		v.loading, v.tried = loading, time.Now()
+		v.mu.Unlock()
+		err := v.load()
+		v.mu.Lock()
+		v.loading, v.loadErr = nil, err
+		close(loading)
+		key, ok = v.keys[kid]
+	} else if loading := v.loading; loading != nil && !ok {
+		v.mu.Unlock()
+		<-loading
+		v.mu.Lock()
+		key, ok = v.keys[kid]
+	}
+	err := v.loadErr
+	v.mu.Unlock()
+	if !ok {
+		if err != nil {
+			return nil, err
+		}
+		return nil, errJWTKey
+	}
+	return key, nil
+}
+
+// Verify verifies token and returns its claims. Token without exp claim, or
+// user claim, or with crit header, is rejected.
+func (v *JWTVerifier) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTFormat
+	}
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Crit []string `json:"crit"`
+	}
+	if err := jwtDecode(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Crit != nil {
+		return nil, errJWTCritical
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTFormat
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := jwtVerifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := jwtDecode(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errJWTNoExp
+	}
+	if !now.Before(jwtTime(exp).Add(v.Leeway)) {
+		return nil, errJWTExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.Leeway).Before(jwtTime(nbf)) {
+		return nil, errJWTNotYet
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return nil, errJWTIssuer
+	}
+	if v.Audience != "" && !jwtHasAudience(claims["aud"], v.Audience) {
+		return nil, errJWTAudience
+	}
+	if v.user(claims) == "" {
+		return nil, errJWTNoUser
+	}
+	return claims, nil
+}
+
+// user returns user name in claims.
+func (v *JWTVerifier) user(claims map[string]interface{}) string {
+	c := v.UserClaim
+	if c == "" {
+		c = "sub"
+	}
+	s, _ := claims[c].(string)
+	return s
+}
+
+func jwtDecode(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return errJWTFormat
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errJWTFormat
+	}
+	return nil
+}
+
+func jwtTime(t float64) time.Time {
+	return time.Unix(0, int64(t*float64(time.Second)))
+}
+
+func jwtHasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwtVerifySignature verifies JWS signature of signed data by key given
+// algorithm. Algorithm must match type of key, and curve of ES key.
+func jwtVerifySignature(alg string, key interface{}, signed []byte, sig []byte) error {
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, signed, sig) {
+			return errJWTSignature
+		}
+		return nil
+	}
+	if len(alg) != 5 {
+		return errJWTAlgorithm
+	}
+	var hash crypto.Hash
+	var curveBits int
+	switch alg[2:] {
+	case "256":
+		hash, curveBits = crypto.SHA256, 256
+	case "384":
+		hash, curveBits = crypto.SHA384, 384
+	case "512":
+		hash, curveBits = crypto.SHA512, 521
+	default:
+		return errJWTAlgorithm
+	}
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		d := sha256.Sum256(signed)
+		digest = d[:]
+	case crypto.SHA384:
+		d := sha512.Sum384(signed)
+		digest = d[:]
+	case crypto.SHA512:
+		d := sha512.Sum512(signed)
+		digest = d[:]
+	}
+	ok := false
+	switch alg[:2] {
+	case "RS":
+		if pub, isRSA := key.(*rsa.PublicKey); isRSA {
+			ok = rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+		}
+	case "PS":
+		if pub, isRSA := key.(*rsa.PublicKey); isRSA {
+			ok = rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case "ES":
+		if pub, isEC := key.(*ecdsa.PublicKey); isEC && pub.Curve.Params().BitSize == curveBits {
+			size := (curveBits + 7) / 8
+			if len(sig) == 2*size {
+				r := new(big.Int).SetBytes(sig[:size])
+				s := new(big.Int).SetBytes(sig[size:])
+				ok = ecdsa.Verify(pub, digest, r, s)
+			}
+		}
+	case "HS":
+		if secret, isOct := key.([]byte); isOct {
+			mac := hmac.New(hash.New, secret)
+			mac.Write(signed)
+			ok = hmac.Equal(mac.Sum(nil), sig)
+		}
+	default:
+		return errJWTAlgorithm
+	}
+	if !ok {
+		return errJWTSignature
+	}
+	return nil
+}
+
+// doBearerAuth verifies Bearer token by Proxy.JWTVerifier, and sets claims
+// and user of context.
+func (ctx *Context) doBearerAuth(token string) bool {
+	v := ctx.Prx.JWTVerifier
+	claims, err := v.Verify(strings.TrimSpace(token))
+	if err != nil {
+		ctx.doError("Auth", ErrBearerAuth, err)
+		return false
+	}
+	ctx.Claims = claims
+	ctx.AuthUser = v.user(claims)
+	return true
+}
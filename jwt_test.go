@@ -0,0 +1,280 @@
+package httpproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// jwtTestKeys are signing keys of tests by key ID.
+type jwtTestKeys map[string]crypto.PrivateKey
+
+// jwks returns JWKS of public keys.
+func (keys jwtTestKeys) jwks() []byte {
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range keys {
+		k := jwk{Kid: kid}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			k.Kty, k.N, k.E = "RSA", b64(key.N.Bytes()), b64(big.NewInt(int64(key.E)).Bytes())
+		case *ecdsa.PrivateKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			k.Kty, k.Crv = "EC", key.Curve.Params().Name
+			k.X, k.Y = b64(key.X.FillBytes(make([]byte, size))), b64(key.Y.FillBytes(make([]byte, size)))
+		case ed25519.PrivateKey:
+			k.Kty, k.Crv, k.X = "OKP", "Ed25519", b64(key.Public().(ed25519.PublicKey))
+		case []byte:
+			k.Kty, k.K = "oct", b64(key)
+		}
+		set.Keys = append(set.Keys, k)
+	}
+	b, _ := json.Marshal(set)
+	return b
+}
+
+// jwtTestSign returns a token of header and claims signed by key given
+// algorithm.
+func jwtTestSign(t *testing.T, header map[string]interface{}, claims map[string]interface{}, key crypto.PrivateKey) string {
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(header) + "." + enc(claims)
+	alg, _ := header["alg"].(string)
+	var sig []byte
+	var err error
+	if alg == "EdDSA" {
+		sig = ed25519.Sign(key.(ed25519.PrivateKey), []byte(signed))
+	} else if hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[len(alg)/2:]]; len(alg) == 5 && hash != 0 {
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest := h.Sum(nil)
+		switch alg[:2] {
+		case "RS":
+			sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), hash, digest)
+		case "PS":
+			sig, err = rsa.SignPSS(rand.Reader, key.(*rsa.PrivateKey), hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		case "ES":
+			k := key.(*ecdsa.PrivateKey)
+			var r, s *big.Int
+			r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+			size := (k.Curve.Params().BitSize + 7) / 8
+			sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+		case "HS":
+			mac := hmac.New(hash.New, key.([]byte))
+			mac.Write([]byte(signed))
+			sig = mac.Sum(nil)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// newTestJWTVerifier returns a JWTVerifier of keys in a JWKS file.
+func newTestJWTVerifier(t *testing.T, keys jwtTestKeys) (*JWTVerifier, string) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, keys.jwks(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewJWTVerifier(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, path
+}
+
+func jwtTestClaims() map[string]interface{} {
+	return map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func TestJWTVerifierAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := jwtTestKeys{"rsa": rsaKey, "hmac": []byte("0123456789abcdef0123456789abcdef")}
+	for _, c := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		k, err := ecdsa.GenerateKey(c, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[c.Params().Name] = k
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys["ed25519"] = edKey
+	v, _ := newTestJWTVerifier(t, keys)
+
+	tests := []struct {
+		alg string
+		kid string
+	}{
+		{"RS256", "rsa"}, {"RS384", "rsa"}, {"RS512", "rsa"},
+		{"PS256", "rsa"}, {"PS384", "rsa"}, {"PS512", "rsa"},
+		{"ES256", "P-256"}, {"ES384", "P-384"}, {"ES512", "P-521"},
+		{"EdDSA", "ed25519"},
+		{"HS256", "hmac"}, {"HS384", "hmac"}, {"HS512", "hmac"},
+	}
+	for _, tt := range tests {
+		token := jwtTestSign(t, map[string]interface{}{"alg": tt.alg, "kid": tt.kid}, jwtTestClaims(), keys[tt.kid])
+		claims, err := v.Verify(token)
+		if err != nil || claims["sub"] != "alice" {
+			t.Errorf("%s: claims %v, error %v", tt.alg, claims, err)
+		}
+		// Tampered signature.
+		if _, err := v.Verify(token[:len(token)-4] + "AAAA"); err != errJWTSignature && err != errJWTFormat {
+			t.Errorf("%s tampered: %v", tt.alg, err)
+		}
+	}
+
+	// ES algorithm is bound to its curve.
+	for _, tt := range []struct{ alg, kid string }{{"ES256", "P-384"}, {"ES384", "P-521"}, {"ES512", "P-256"}} {
+		token := jwtTestSign(t, map[string]interface{}{"alg": tt.alg, "kid": tt.kid}, jwtTestClaims(), keys[tt.kid])
+		if _, err := v.Verify(token); err != errJWTSignature {
+			t.Errorf("%s with %s key: %v, want %v", tt.alg, tt.kid, err, errJWTSignature)
+		}
+	}
+
+	// RS key can't verify HS token signed by its public key as a secret.
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	token := jwtTestSign(t, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, jwtTestClaims(), der)
+	if _, err := v.Verify(token); err != errJWTSignature {
+		t.Errorf("RS to HS confusion: %v, want %v", err, errJWTSignature)
+	}
+	token = jwtTestSign(t, map[string]interface{}{"alg": "RS256", "kid": "hmac"}, jwtTestClaims(), rsaKey)
+	if _, err := v.Verify(token); err != errJWTSignature {
+		t.Errorf("RS with HS key: %v, want %v", err, errJWTSignature)
+	}
+
+	for _, alg := range []string{"none", "None", "HS1", "RS128", ""} {
+		token := jwtTestSign(t, map[string]interface{}{"alg": alg, "kid": "hmac"}, jwtTestClaims(), nil)
+		if _, err := v.Verify(token); err != errJWTAlgorithm {
+			t.Errorf("alg %q: %v, want %v", alg, err, errJWTAlgorithm)
+		}
+	}
+}
+
+func TestJWTVerifierClaims(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	v, _ := newTestJWTVerifier(t, jwtTestKeys{"k": secret})
+	v.Issuer = "https://issuer.example"
+	v.Audience = "proxy"
+	v.Leeway = time.Minute
+	now := time.Now().Unix()
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"sub": "alice", "iss": "https://issuer.example", "aud": "proxy", "exp": now + 600}
+	}
+	tests := []struct {
+		name   string
+		header map[string]interface{}
+		change func(c map[string]interface{})
+		want   error
+	}{
+		{"valid", nil, func(c map[string]interface{}) {}, nil},
+		{"audience list", nil, func(c map[string]interface{}) { c["aud"] = []string{"other", "proxy"} }, nil},
+		{"exp in leeway", nil, func(c map[string]interface{}) { c["exp"] = now - 30 }, nil},
+		{"nbf in leeway", nil, func(c map[string]interface{}) { c["nbf"] = now + 30 }, nil},
+		{"expired", nil, func(c map[string]interface{}) { c["exp"] = now - 120 }, errJWTExpired},
+		{"no exp", nil, func(c map[string]interface{}) { delete(c, "exp") }, errJWTNoExp},
+		{"not yet", nil, func(c map[string]interface{}) { c["nbf"] = now + 120 }, errJWTNotYet},
+		{"audience", nil, func(c map[string]interface{}) { c["aud"] = "other" }, errJWTAudience},
+		{"no audience", nil, func(c map[string]interface{}) { delete(c, "aud") }, errJWTAudience},
+		{"issuer", nil, func(c map[string]interface{}) { c["iss"] = "https://other.example" }, errJWTIssuer},
+		{"no user", nil, func(c map[string]interface{}) { delete(c, "sub") }, errJWTNoUser},
+		{"user not string", nil, func(c map[string]interface{}) { c["sub"] = 1 }, errJWTNoUser},
+		{"crit", map[string]interface{}{"crit": []string{"b64"}, "b64": false}, func(c map[string]interface{}) {}, errJWTCritical},
+		{"empty crit", map[string]interface{}{"crit": []string{}}, func(c map[string]interface{}) {}, errJWTCritical},
+	}
+	for _, tt := range tests {
+		header := map[string]interface{}{"alg": "HS256", "kid": "k"}
+		for k, v := range tt.header {
+			header[k] = v
+		}
+		claims := valid()
+		tt.change(claims)
+		if _, err := v.Verify(jwtTestSign(t, header, claims, secret)); err != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	v.UserClaim = "email"
+	claims := valid()
+	claims["email"] = "alice@example.com"
+	ctx := &Context{Prx: &Proxy{JWTVerifier: v}}
+	if !ctx.doBearerAuth(jwtTestSign(t, map[string]interface{}{"alg": "HS256", "kid": "k"}, claims, secret)) ||
+		ctx.AuthUser != "alice@example.com" || ctx.Claims["sub"] != "alice" {
+		t.Errorf("user claim: AuthUser %q, claims %v", ctx.AuthUser, ctx.Claims)
+	}
+
+	for _, token := range []string{"", "a.b", "a.b.c.d", "!.e30.", "e30.e30.!"} {
+		if _, err := v.Verify(token); err != errJWTFormat {
+			t.Errorf("token %q: %v, want %v", token, err, errJWTFormat)
+		}
+	}
+}
+
+func TestJWTVerifierReload(t *testing.T) {
+	oldKey, newKey := []byte("old secret of 32 bytes of length"), []byte("new secret of 32 bytes of length")
+	v, path := newTestJWTVerifier(t, jwtTestKeys{"old": oldKey})
+	oldToken := jwtTestSign(t, map[string]interface{}{"alg": "HS256", "kid": "old"}, jwtTestClaims(), oldKey)
+	newToken := jwtTestSign(t, map[string]interface{}{"alg": "HS256", "kid": "new"}, jwtTestClaims(), newKey)
+	if _, err := v.Verify(oldToken); err != nil {
+		t.Fatalf("known key: %v", err)
+	}
+
+	// Key rotation.
+	if err := ioutil.WriteFile(path, jwtTestKeys{"new": newKey}.jwks(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Unknown key ID doesn't reload JWKS within jwksMinReloadInterval of
+	// the last load.
+	if _, err := v.Verify(newToken); err != errJWTKey {
+		t.Errorf("unknown key before reload interval: %v, want %v", err, errJWTKey)
+	}
+	v.mu.Lock()
+	v.tried = time.Now().Add(-jwksMinReloadInterval)
+	v.mu.Unlock()
+	if _, err := v.Verify(newToken); err != nil {
+		t.Errorf("unknown key after reload interval: %v", err)
+	}
+	if _, err := v.Verify(oldToken); err != errJWTKey {
+		t.Errorf("removed key: %v, want %v", err, errJWTKey)
+	}
+
+	// Stale JWKS is reloaded by RefreshInterval for known key IDs too, and
+	// keys stay if reload fails.
+	v.RefreshInterval = time.Millisecond
+	ioutil.WriteFile(path, []byte("not JSON"), 0600)
+	v.mu.Lock()
+	v.loaded = time.Now().Add(-time.Second)
+	v.tried = time.Now().Add(-jwksMinReloadInterval)
+	v.mu.Unlock()
+	if _, err := v.Verify(newToken); err != nil {
+		t.Errorf("known key with failed reload: %v", err)
+	}
+	if _, err := v.Verify(oldToken); err == nil || err == errJWTKey {
+		t.Errorf("unknown key with failed reload: %v, want load error", err)
+	}
+}
@@ -0,0 +1,555 @@
+package httpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// LDAP protocol operation tags and result codes used by LDAPAuthenticator.
+const (
+	ldapBindRequest       = 0x60
+	ldapBindResponse      = 0x61
+	ldapUnbindRequest     = 0x42
+	ldapSearchRequest     = 0x63
+	ldapSearchResultEntry = 0x64
+	ldapSearchResultDone  = 0x65
+	ldapExtendedRequest   = 0x77
+	ldapExtendedResponse  = 0x78
+
+	ldapScopeBase    = 0
+	ldapScopeSubtree = 2
+
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+	// Maximum length of an LDAP message read from server.
+	ldapMaxMessageLen = 16 << 20
+)
+
+// Errors of LDAP authentication.
+var (
+	errLDAPMessage = errors.New("invalid LDAP message")
+	errLDAPFilter  = errors.New("invalid LDAP filter")
+	errLDAPUser    = errors.New("LDAP user not found")
+)
+
+// ldapResultError is a non-success result of an LDAP operation.
+type ldapResultError struct {
+	code    int
+	message string
+}
+
+func (e *ldapResultError) Error() string {
+	return fmt.Sprintf("LDAP result code %d: %s", e.code, e.message)
+}
+
+// LDAPAuthenticator authenticates users by LDAP simple bind. The user DN is
+// built from UserDN, or searched by UserFilter under BaseDN before bind.
+// Groups of user are set to ctx.AuthGroups. Every authentication binds to
+// LDAP server; to cache successful authentications, set Proxy.AuthGuard with
+// CacheTTL. It's safe for concurrent use.
+type LDAPAuthenticator struct {
+	// Address of LDAP server, "host:port".
+	Addr string
+
+	// TLS config of LDAP server. If StartTLS is false, connection uses TLS
+	// from start (LDAPS).
+	// By default, nil; connection isn't encrypted unless StartTLS is true.
+	TLSConfig *tls.Config
+
+	// If it's true, connection is upgraded to TLS by StartTLS operation. If
+	// TLSConfig is nil, server certificate is verified by system roots and
+	// host of Addr.
+	// By default, false.
+	StartTLS bool
+
+	// DN template of user to bind directly, e.g.
+	// "uid=%s,ou=people,dc=example,dc=com". If it's set, BindDN, BaseDN and
+	// UserFilter are ignored.
+	// By default, "".
+	UserDN string
+
+	// DN and password to bind before searching user. If BindDN is "",
+	// search is anonymous.
+	// By default, "".
+	BindDN       string
+	BindPassword string
+
+	// Base DN to search user under.
+	BaseDN string
+
+	// Filter template to search user, e.g. "(&(objectClass=person)(uid=%s))".
+	// By default, "(uid=%s)".
+	UserFilter string
+
+	// Attribute of user entry listing groups of user.
+	// By default, "memberOf".
+	GroupAttribute string
+
+	// Timeout of connecting and each operation.
+	// By default, 10 seconds.
+	Timeout time.Duration
+}
+
+// Auth authenticates user by LDAP bind, and sets groups of user to
+// ctx.AuthGroups. Set it to Proxy.OnAuth.
+func (a *LDAPAuthenticator) Auth(ctx *Context, authType string, user string, pass string) bool {
+	if user == "" || pass == "" {
+		// Empty password makes an unauthenticated bind, which succeeds.
+		return false
+	}
+	groups, err := a.authenticate(user, pass)
+	if err != nil {
+		if rerr, ok := err.(*ldapResultError); !(ok && rerr.code == ldapResultInvalidCredentials) && err != errLDAPUser {
+			ctx.doError("Auth", ErrLDAP, err)
+		}
+		return false
+	}
+	ctx.AuthGroups = groups
+	return true
+}
+
+// authenticate binds as user and returns groups of user.
+func (a *LDAPAuthenticator) authenticate(user string, pass string) ([]string, error) {
+	c, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	groupAttr := a.GroupAttribute
+	if groupAttr == "" {
+		groupAttr = "memberOf"
+	}
+	if a.UserDN != "" {
+		dn := fmt.Sprintf(a.UserDN, ldapEscapeDN(user))
+		if err := c.bind(dn, pass); err != nil {
+			return nil, err
+		}
+		entries, err := c.search(dn, ldapScopeBase, "(objectClass=*)", []string{groupAttr})
+		if err != nil {
+			return nil, err
+		}
+		var groups []string
+		for _, entry := range entries {
+			groups = append(groups, entry.attrs[strings.ToLower(groupAttr)]...)
+		}
+		return groups, nil
+	}
+	if a.BindDN != "" {
+		if err := c.bind(a.BindDN, a.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+	filter := a.UserFilter
+	if filter == "" {
+		filter = "(uid=%s)"
+	}
+	entries, err := c.search(a.BaseDN, ldapScopeSubtree, fmt.Sprintf(filter, ldapEscapeFilter(user)), []string{groupAttr})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, errLDAPUser
+	}
+	if err := c.bind(entries[0].dn, pass); err != nil {
+		return nil, err
+	}
+	return entries[0].attrs[strings.ToLower(groupAttr)], nil
+}
+
+// ldapConn is a client connection to LDAP server.
+type ldapConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	msgID   int
+	timeout time.Duration
+}
+
+// ldapEntry is an entry of search result. Attribute names are lower case.
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+func (a *LDAPAuthenticator) dial() (*ldapConn, error) {
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", a.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &ldapConn{conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+	if !a.StartTLS && a.TLSConfig == nil {
+		return c, nil
+	}
+	if a.StartTLS {
+		req := berEncode(ldapExtendedRequest, berString(0x80, ldapStartTLSOID))
+		if _, err := c.request(req, ldapExtendedResponse); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	tlsConn := tls.Client(conn, a.tlsConfig())
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+	return c, nil
+}
+
+// tlsConfig returns TLSConfig, or a default config, with ServerName of Addr
+// if it isn't set.
+func (a *LDAPAuthenticator) tlsConfig() *tls.Config {
+	config := &tls.Config{}
+	if a.TLSConfig != nil {
+		config = a.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(a.Addr); err == nil {
+			config.ServerName = host
+		}
+	}
+	return config
+}
+
+func (c *ldapConn) close() {
+	c.msgID++
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	c.conn.Write(berEncode(0x30, berInt(0x02, c.msgID), []byte{ldapUnbindRequest, 0}))
+	c.conn.Close()
+}
+
+// request sends protocol operation, and returns responses until the one
+// with tag done. Its result must be success.
+func (c *ldapConn) request(op []byte, done byte) ([]berElement, error) {
+	c.msgID++
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(berEncode(0x30, berInt(0x02, c.msgID), op)); err != nil {
+		return nil, err
+	}
+	var resps []berElement
+	for {
+		tag, data, err := berRead(c.r)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := berParse(data)
+		if tag != 0x30 || err != nil || len(msg) < 2 || msg[0].tag != 0x02 {
+			return nil, errLDAPMessage
+		}
+		if msg[0].int() != c.msgID {
+			continue
+		}
+		if msg[1].tag != done {
+			resps = append(resps, msg[1])
+			continue
+		}
+		result, err := berParse(msg[1].data)
+		if err != nil || len(result) < 3 || result[0].tag != 0x0a {
+			return nil, errLDAPMessage
+		}
+		if code := result[0].int(); code != ldapResultSuccess {
+			return nil, &ldapResultError{code, string(result[2].data)}
+		}
+		return resps, nil
+	}
+}
+
+func (c *ldapConn) bind(dn string, pass string) error {
+	_, err := c.request(berEncode(ldapBindRequest, berInt(0x02, 3), berString(0x04, dn), berString(0x80, pass)),
+		ldapBindResponse)
+	return err
+}
+
+func (c *ldapConn) search(base string, scope int, filter string, attrs []string) ([]*ldapEntry, error) {
+	f, err := ldapFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var attrList [][]byte
+	for _, attr := range attrs {
+		attrList = append(attrList, berString(0x04, attr))
+	}
+	req := berEncode(ldapSearchRequest, berString(0x04, base), berInt(0x0a, scope), berInt(0x0a, 0),
+		berInt(0x02, 2), berInt(0x02, int(c.timeout/time.Second)), []byte{0x01, 1, 0}, f,
+		berEncode(0x30, attrList...))
+	resps, err := c.request(req, ldapSearchResultDone)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*ldapEntry
+	for _, resp := range resps {
+		if resp.tag != ldapSearchResultEntry {
+			continue
+		}
+		parts, err := berParse(resp.data)
+		if err != nil || len(parts) < 2 {
+			return nil, errLDAPMessage
+		}
+		entry := &ldapEntry{dn: string(parts[0].data), attrs: make(map[string][]string)}
+		attrSeqs, err := berParse(parts[1].data)
+		if err != nil {
+			return nil, errLDAPMessage
+		}
+		for _, attrSeq := range attrSeqs {
+			attr, err := berParse(attrSeq.data)
+			if err != nil || len(attr) < 2 {
+				return nil, errLDAPMessage
+			}
+			vals, err := berParse(attr[1].data)
+			if err != nil {
+				return nil, errLDAPMessage
+			}
+			name := strings.ToLower(string(attr[0].data))
+			for _, v := range vals {
+				entry.attrs[name] = append(entry.attrs[name], string(v.data))
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ldapFilter encodes string representation of a search filter (RFC 4515).
+// It supports and, or, not, equality and presence filters.
+func ldapFilter(s string) ([]byte, error) {
+	f, rest, err := ldapParseFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, errLDAPFilter
+	}
+	return f, nil
+}
+
+func ldapParseFilter(s string) ([]byte, string, error) {
+	if len(s) < 2 || s[0] != '(' {
+		return nil, "", errLDAPFilter
+	}
+	s = s[1:]
+	switch s[0] {
+	case '&', '|', '!':
+		op := s[0]
+		s = s[1:]
+		var subs [][]byte
+		for strings.HasPrefix(s, "(") {
+			var sub []byte
+			var err error
+			if sub, s, err = ldapParseFilter(s); err != nil {
+				return nil, "", err
+			}
+			subs = append(subs, sub)
+		}
+		if !strings.HasPrefix(s, ")") || (op == '!' && len(subs) != 1) {
+			return nil, "", errLDAPFilter
+		}
+		tag := map[byte]byte{'&': 0xa0, '|': 0xa1, '!': 0xa2}[op]
+		return berEncode(tag, subs...), s[1:], nil
+	}
+	i := strings.IndexByte(s, ')')
+	if i < 0 {
+		return nil, "", errLDAPFilter
+	}
+	item := s[:i]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", errLDAPFilter
+	}
+	attr, value := item[:eq], item[eq+1:]
+	if value == "*" {
+		return berString(0x87, attr), s[i+1:], nil
+	}
+	v, err := ldapUnescapeFilter(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berEncode(0xa3, berString(0x04, attr), berString(0x04, v)), s[i+1:], nil
+}
+
+func ldapUnescapeFilter(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+2 >= len(s) {
+				return "", errLDAPFilter
+			}
+			c, err := hex.DecodeString(s[i+1 : i+3])
+			if err != nil {
+				return "", errLDAPFilter
+			}
+			b.Write(c)
+			i += 2
+		case '*', '(', ')':
+			return "", errLDAPFilter
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// ldapEscapeFilter escapes value in a search filter (RFC 4515).
+func ldapEscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ldapEscapeDN escapes attribute value in a DN (RFC 4514).
+func ldapEscapeDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			(c == '#' || c == ' ') && i == 0,
+			c == ' ' && i == len(s)-1:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// berElement is a BER encoded element with its content.
+type berElement struct {
+	tag  byte
+	data []byte
+}
+
+// int returns value of integer or enumerated element.
+func (e berElement) int() int {
+	v := 0
+	for i, c := range e.data {
+		if i == 0 && c&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int(c)
+	}
+	return v
+}
+
+// berEncode returns BER element given tag and contents.
+func berEncode(tag byte, contents ...[]byte) []byte {
+	n := 0
+	for _, c := range contents {
+		n += len(c)
+	}
+	b := []byte{tag}
+	if n < 0x80 {
+		b = append(b, byte(n))
+	} else {
+		var l []byte
+		for m := n; m > 0; m >>= 8 {
+			l = append([]byte{byte(m)}, l...)
+		}
+		b = append(append(b, 0x80|byte(len(l))), l...)
+	}
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+func berInt(tag byte, v int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		if v >= -0x80 && v < 0x80 {
+			return berEncode(tag, b)
+		}
+		v >>= 8
+	}
+}
+
+// berRead reads a BER element from r.
+func berRead(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	l, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n := int(l)
+	if l&0x80 != 0 {
+		if l&0x7f > 4 {
+			return 0, nil, errLDAPMessage
+		}
+		n = 0
+		for i := 0; i < int(l&0x7f); i++ {
+			c, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			n = n<<8 | int(c)
+		}
+	}
+	if n > ldapMaxMessageLen {
+		return 0, nil, errLDAPMessage
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return tag, data, nil
+}
+
+// berParse parses contents of a constructed BER element.
+func berParse(b []byte) ([]berElement, error) {
+	var elems []berElement
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, errLDAPMessage
+		}
+		tag, n, off := b[0], int(b[1]), 2
+		if b[1]&0x80 != 0 {
+			ll := int(b[1] & 0x7f)
+			if ll > 4 || len(b) < 2+ll {
+				return nil, errLDAPMessage
+			}
+			n = 0
+			for _, c := range b[2 : 2+ll] {
+				n = n<<8 | int(c)
+			}
+			off += ll
+		}
+		if n < 0 || n > len(b)-off {
+			return nil, errLDAPMessage
+		}
+		elems = append(elems, berElement{tag, b[off : off+n]})
+		b = b[off+n:]
+	}
+	return elems, nil
+}
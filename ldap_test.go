@@ -0,0 +1,298 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLDAPServer is an in-process LDAP server. It serves simple binds of
+// users, base searches of their DNs, subtree searches finding users by uid
+// in filter, and StartTLS.
+type testLDAPServer struct {
+	l      net.Listener
+	config *tls.Config
+
+	mu    sync.Mutex
+	binds []testLDAPBind
+}
+
+// testLDAPBind is a bind received by testLDAPServer.
+type testLDAPBind struct {
+	dn  string
+	tls bool
+}
+
+var testLDAPUsers = map[string]struct {
+	uid    string
+	pass   string
+	groups []string
+}{
+	"uid=alice,ou=people,dc=example": {"alice", "alice-pw", []string{"cn=dev,ou=groups,dc=example", "cn=ops,ou=groups,dc=example"}},
+	"uid=bob,ou=people,dc=example":   {"bob", "bob-pw", nil},
+	"cn=svc,dc=example":              {"", "svc-pw", nil},
+}
+
+func newTestLDAPServer(t *testing.T) *testLDAPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testLDAPServer{l: l, config: &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	r := bufio.NewReader(conn)
+	isTLS := false
+	for {
+		_, data, err := berRead(r)
+		if err != nil {
+			return
+		}
+		msg, err := berParse(data)
+		if err != nil || len(msg) < 2 {
+			return
+		}
+		id := berInt(0x02, msg[0].int())
+		op := msg[1]
+		result := func(tag byte, code int) []byte {
+			return berEncode(0x30, id, berEncode(tag, berInt(0x0a, code), berString(0x04, ""), berString(0x04, "")))
+		}
+		switch op.tag {
+		case ldapExtendedRequest:
+			conn.Write(result(ldapExtendedResponse, ldapResultSuccess))
+			tlsConn := tls.Server(conn, s.config)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, r, isTLS = tlsConn, bufio.NewReader(tlsConn), true
+		case ldapBindRequest:
+			p, _ := berParse(op.data)
+			dn, pass := string(p[1].data), string(p[2].data)
+			s.mu.Lock()
+			s.binds = append(s.binds, testLDAPBind{dn, isTLS})
+			s.mu.Unlock()
+			code := ldapResultInvalidCredentials
+			if u, ok := testLDAPUsers[dn]; ok && pass != "" && pass == u.pass {
+				code = ldapResultSuccess
+			}
+			conn.Write(result(ldapBindResponse, code))
+		case ldapSearchRequest:
+			p, _ := berParse(op.data)
+			base, scope, filter := string(p[0].data), p[1].int(), p[6].data
+			for dn, u := range testLDAPUsers {
+				if u.uid == "" {
+					continue
+				}
+				if (scope == ldapScopeBase && base == dn) ||
+					(scope == ldapScopeSubtree && bytes.Contains(filter, berString(0x04, u.uid))) {
+					var vals [][]byte
+					for _, g := range u.groups {
+						vals = append(vals, berString(0x04, g))
+					}
+					attrs := berEncode(0x30, berEncode(0x30, berString(0x04, "memberOf"), berEncode(0x31, vals...)))
+					conn.Write(berEncode(0x30, id, berEncode(ldapSearchResultEntry, berString(0x04, dn), attrs)))
+				}
+			}
+			conn.Write(result(ldapSearchResultDone, ldapResultSuccess))
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+func (s *testLDAPServer) takeBinds() []testLDAPBind {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	binds := s.binds
+	s.binds = nil
+	return binds
+}
+
+// testCertificate returns a self-signed certificate of 127.0.0.1.
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+func newTestLDAPContext(t *testing.T) *Context {
+	return &Context{Prx: &Proxy{OnError: func(ctx *Context, where string, err *Error, opErr error) {
+		t.Logf("%s: %v: %v", where, err, opErr)
+	}}}
+}
+
+func TestLDAPAuthSearch(t *testing.T) {
+	s := newTestLDAPServer(t)
+	a := &LDAPAuthenticator{Addr: s.l.Addr().String(), BindDN: "cn=svc,dc=example", BindPassword: "svc-pw",
+		BaseDN: "dc=example", UserFilter: "(&(objectClass=person)(uid=%s))", Timeout: 5 * time.Second}
+	tests := []struct {
+		user   string
+		pass   string
+		ok     bool
+		groups []string
+		binds  []string
+	}{
+		{"alice", "alice-pw", true, testLDAPUsers["uid=alice,ou=people,dc=example"].groups,
+			[]string{"cn=svc,dc=example", "uid=alice,ou=people,dc=example"}},
+		{"bob", "bob-pw", true, nil, []string{"cn=svc,dc=example", "uid=bob,ou=people,dc=example"}},
+		{"alice", "wrong", false, nil, []string{"cn=svc,dc=example", "uid=alice,ou=people,dc=example"}},
+		{"alice", "", false, nil, nil},
+		{"carol", "pw", false, nil, []string{"cn=svc,dc=example"}},
+		{"*", "pw", false, nil, []string{"cn=svc,dc=example"}},
+		{"alice)(uid=*", "alice-pw", false, nil, []string{"cn=svc,dc=example"}},
+	}
+	for _, tt := range tests {
+		ctx := newTestLDAPContext(t)
+		if ok := a.Auth(ctx, "Basic", tt.user, tt.pass); ok != tt.ok {
+			t.Errorf("Auth(%q, %q) = %v, want %v", tt.user, tt.pass, ok, tt.ok)
+		}
+		if !reflect.DeepEqual(ctx.AuthGroups, tt.groups) {
+			t.Errorf("Auth(%q, %q) groups = %q, want %q", tt.user, tt.pass, ctx.AuthGroups, tt.groups)
+		}
+		var binds []string
+		for _, b := range s.takeBinds() {
+			binds = append(binds, b.dn)
+		}
+		if !reflect.DeepEqual(binds, tt.binds) {
+			t.Errorf("Auth(%q, %q) binds = %q, want %q", tt.user, tt.pass, binds, tt.binds)
+		}
+	}
+}
+
+func TestLDAPAuthDirectBind(t *testing.T) {
+	s := newTestLDAPServer(t)
+	a := &LDAPAuthenticator{Addr: s.l.Addr().String(), UserDN: "uid=%s,ou=people,dc=example", Timeout: 5 * time.Second}
+	ctx := newTestLDAPContext(t)
+	if !a.Auth(ctx, "Basic", "alice", "alice-pw") {
+		t.Fatal("Auth failed")
+	}
+	if want := testLDAPUsers["uid=alice,ou=people,dc=example"].groups; !reflect.DeepEqual(ctx.AuthGroups, want) {
+		t.Errorf("groups = %q, want %q", ctx.AuthGroups, want)
+	}
+	if a.Auth(newTestLDAPContext(t), "Basic", "alice", "wrong") {
+		t.Error("Auth succeeded with wrong password")
+	}
+	if a.Auth(newTestLDAPContext(t), "Basic", "alice,ou=people,dc=example", "alice-pw") {
+		t.Error("Auth succeeded with DN injection")
+	}
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	s := newTestLDAPServer(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(s.config.Certificates[0].Leaf)
+	a := &LDAPAuthenticator{Addr: s.l.Addr().String(), StartTLS: true, TLSConfig: &tls.Config{RootCAs: roots},
+		UserDN: "uid=%s,ou=people,dc=example", Timeout: 5 * time.Second}
+	if !a.Auth(newTestLDAPContext(t), "Basic", "alice", "alice-pw") {
+		t.Fatal("Auth failed")
+	}
+	if binds := s.takeBinds(); len(binds) != 1 || !binds[0].tls {
+		t.Errorf("binds = %v, want one over TLS", binds)
+	}
+
+	// Without TLSConfig, server certificate is verified by system roots, and
+	// password is never sent in cleartext.
+	a.TLSConfig = nil
+	if a.Auth(newTestLDAPContext(t), "Basic", "alice", "alice-pw") {
+		t.Error("Auth succeeded with untrusted server certificate")
+	}
+	if binds := s.takeBinds(); len(binds) != 0 {
+		t.Errorf("binds = %v, want none", binds)
+	}
+}
+
+func TestLDAPFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   []byte
+	}{
+		{"(uid=alice)", berEncode(0xa3, berString(0x04, "uid"), berString(0x04, "alice"))},
+		{"(uid=*)", berString(0x87, "uid")},
+		{`(cn=a\2ab)`, berEncode(0xa3, berString(0x04, "cn"), berString(0x04, "a*b"))},
+		{"(&(a=1)(!(b=*))(|(c=2)(d=3)))", berEncode(0xa0,
+			berEncode(0xa3, berString(0x04, "a"), berString(0x04, "1")),
+			berEncode(0xa2, berString(0x87, "b")),
+			berEncode(0xa1,
+				berEncode(0xa3, berString(0x04, "c"), berString(0x04, "2")),
+				berEncode(0xa3, berString(0x04, "d"), berString(0x04, "3"))))},
+		{"uid=alice", nil},
+		{"(uid=alice", nil},
+		{"(uid=a*b)", nil},
+		{`(uid=\2)`, nil},
+		{"(!(a=1)(b=2))", nil},
+		{"(a=1)(b=2)", nil},
+	}
+	for _, tt := range tests {
+		got, err := ldapFilter(tt.filter)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ldapFilter(%q) succeeded, want error", tt.filter)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("ldapFilter(%q) = %x, %v, want %x", tt.filter, got, err, tt.want)
+		}
+	}
+}
+
+func TestLDAPEscape(t *testing.T) {
+	if got, want := ldapEscapeFilter("a*(b)\\\x00"), `a\2a\28b\29\5c\00`; got != want {
+		t.Errorf("ldapEscapeFilter = %q, want %q", got, want)
+	}
+	if got, want := ldapEscapeDN(" #a,b+c=d "), `\ #a\,b\+c\=d\ `; got != want {
+		t.Errorf("ldapEscapeDN = %q, want %q", got, want)
+	}
+	for _, v := range []int{0, 1, 127, 128, 255, 256, 65535, -1, -128, -129} {
+		b := berInt(0x02, v)
+		if got := (berElement{0x02, b[2:]}).int(); got != v {
+			t.Errorf("berInt(%d) = %x, decoded as %d", v, b, got)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package httpproxy
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limits defines per-client limits of proxy. Clients are identified by Key,
+// except for new connections, which are counted by client IP. A zero limit
+// means no limit.
+type Limits struct {
+	// Maximum concurrent CONNECT tunnels, including MITM sessions, of a
+	// client.
+	MaxTunnels int
+
+	// Maximum concurrent MITM requests of a client, over all MITM sessions.
+	MaxMitmRequests int
+
+	// Maximum rate of new proxy requests, including CONNECT requests, of a
+	// client per second.
+	RequestsPerSecond float64
+
+	// Maximum burst of new proxy requests over RequestsPerSecond.
+	// By default, RequestsPerSecond rounded up.
+	RequestsBurst int
+
+	// Maximum rate of new client connections of a client IP per second.
+	// Connections are counted by Proxy.ConnState, so it must be set to
+	// http.Server.ConnState. Requests of a connection over the rate are
+	// rejected, and the connection is closed.
+	ConnectionsPerSecond float64
+
+	// Maximum burst of new client connections over ConnectionsPerSecond.
+	// By default, ConnectionsPerSecond rounded up.
+	ConnectionsBurst int
+
+	// Key function identifies client of context.
+	// By default, LimitKeyClientIP.
+	Key func(ctx *Context) string
+
+	// Status code of response to rejected requests, e.g. 429 or 503.
+	// By default, 429.
+	RejectStatusCode int
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimits
+	conns     map[string]*tokenBucket
+	rejected  map[string]bool
+	nextSweep time.Time
+}
+
+// LimitKeyClientIP returns IP address of client, to use as Limits.Key.
+func LimitKeyClientIP(ctx *Context) string {
+	if ctx.Req == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(ctx.Req.RemoteAddr)
+	if err != nil {
+		return ctx.Req.RemoteAddr
+	}
+	return host
+}
+
+// LimitKeyUser returns authenticated user of client, or IP address of client
+// if not authenticated, to use as Limits.Key.
+func LimitKeyUser(ctx *Context) string {
+	if ctx.AuthUser != "" {
+		return "user:" + ctx.AuthUser
+	}
+	return "ip:" + LimitKeyClientIP(ctx)
+}
+
+// Errors describing which limit is exceeded, passed as opErr with
+// ErrLimitExceeded.
+var (
+	errLimitTunnels      = errors.New("too many tunnels")
+	errLimitMitmRequests = errors.New("too many MITM requests")
+	errLimitRequestRate  = errors.New("request rate exceeded")
+	errLimitConnRate     = errors.New("connection rate exceeded")
+)
+
+// clientLimits keeps usage of a client.
+type clientLimits struct {
+	tunnels      int
+	mitmRequests int
+	requests     tokenBucket
+}
+
+// tokenBucket is a token bucket which is filled by rate per second up to
+// burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// fill fills tokens until now. Zero bucket is full.
+func (b *tokenBucket) fill(now time.Time, rate float64, burst float64) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+}
+
+// take takes n tokens, if available.
+func (b *tokenBucket) take(now time.Time, rate float64, burst float64, n float64) bool {
+	b.fill(now, rate, burst)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// reserve takes n tokens even if they aren't available, and returns duration
+// until they're available.
+func (b *tokenBucket) reserve(now time.Time, rate float64, burst float64, n float64) time.Duration {
+	b.fill(now, rate, burst)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// full checks the bucket is full at now.
+func (b *tokenBucket) full(now time.Time, rate float64, burst float64) bool {
+	return b.last.IsZero() || b.tokens+now.Sub(b.last).Seconds()*rate >= burst
+}
+
+func (l *Limits) key(ctx *Context) string {
+	if l.Key != nil {
+		return l.Key(ctx)
+	}
+	return LimitKeyClientIP(ctx)
+}
+
+func (l *Limits) burst() float64 {
+	if l.RequestsBurst > 0 {
+		return float64(l.RequestsBurst)
+	}
+	return math.Max(1, math.Ceil(l.RequestsPerSecond))
+}
+
+func (l *Limits) connBurst() float64 {
+	if l.ConnectionsBurst > 0 {
+		return float64(l.ConnectionsBurst)
+	}
+	return math.Max(1, math.Ceil(l.ConnectionsPerSecond))
+}
+
+// sweep removes full connection buckets of client IPs. l.mu must be locked.
+func (l *Limits) sweep(now time.Time) {
+	if now.Before(l.nextSweep) {
+		return
+	}
+	for ip, b := range l.conns {
+		if b.full(now, l.ConnectionsPerSecond, l.connBurst()) {
+			delete(l.conns, ip)
+		}
+	}
+	l.nextSweep = now.Add(time.Minute)
+}
+
+// connState counts new client connection of key by client IP, and marks it
+// rejected if the rate is exceeded.
+func (l *Limits) connState(key string, ip string, state http.ConnState) {
+	if l.ConnectionsPerSecond <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		now := time.Now()
+		l.sweep(now)
+		if l.conns == nil {
+			l.conns = make(map[string]*tokenBucket)
+		}
+		b := l.conns[ip]
+		if b == nil {
+			b = &tokenBucket{}
+			l.conns[ip] = b
+		}
+		if !b.take(now, l.ConnectionsPerSecond, l.connBurst(), 1) {
+			if l.rejected == nil {
+				l.rejected = make(map[string]bool)
+			}
+			l.rejected[key] = true
+		}
+	case http.StateClosed, http.StateHijacked:
+		delete(l.rejected, key)
+	}
+}
+
+// connRejected checks client connection of key is over the connection rate.
+func (l *Limits) connRejected(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rejected[key]
+}
+
+func (l *Limits) client(key string) *clientLimits {
+	if l.clients == nil {
+		l.clients = make(map[string]*clientLimits)
+	}
+	c := l.clients[key]
+	if c == nil {
+		c = &clientLimits{}
+		l.clients[key] = c
+	}
+	return c
+}
+
+// release removes usage of client if it's idle.
+func (l *Limits) release(key string, c *clientLimits) {
+	if c.tunnels == 0 && c.mitmRequests == 0 &&
+		(l.RequestsPerSecond <= 0 || c.requests.full(time.Now(), l.RequestsPerSecond, l.burst())) {
+		delete(l.clients, key)
+	}
+}
+
+// acquire takes a proxy request, and a tunnel if tunnel is true, of key. If a
+// limit is exceeded, it returns the error.
+func (l *Limits) acquire(key string, tunnel bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.client(key)
+	defer l.release(key, c)
+	if tunnel && l.MaxTunnels > 0 && c.tunnels >= l.MaxTunnels {
+		return errLimitTunnels
+	}
+	if l.RequestsPerSecond > 0 && !c.requests.take(time.Now(), l.RequestsPerSecond, l.burst(), 1) {
+		return errLimitRequestRate
+	}
+	if tunnel {
+		c.tunnels++
+	}
+	return nil
+}
+
+func (l *Limits) releaseTunnel(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.client(key)
+	c.tunnels--
+	l.release(key, c)
+}
+
+func (l *Limits) acquireMitmRequest(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.client(key)
+	if l.MaxMitmRequests > 0 && c.mitmRequests >= l.MaxMitmRequests {
+		l.release(key, c)
+		return errLimitMitmRequests
+	}
+	c.mitmRequests++
+	return nil
+}
+
+func (l *Limits) releaseMitmRequest(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.client(key)
+	c.mitmRequests--
+	l.release(key, c)
+}
+
+// doConnLimits checks client connection of request is in the connection
+// rate. Otherwise, it responds rejection, closing the connection, and returns
+// true.
+func (ctx *Context) doConnLimits(w http.ResponseWriter, r *http.Request) bool {
+	l := ctx.Prx.Limits
+	if l == nil || l.ConnectionsPerSecond <= 0 || !l.connRejected(connAuthKey(r)) {
+		return false
+	}
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+	w.Header().Set("Connection", "close")
+	ctx.doError("Limit", ErrLimitExceeded, errLimitConnRate)
+	if err := ctx.serveLimitRejection(w); err != nil && !isConnectionClosed(err) {
+		ctx.doError("Limit", ErrResponseWrite, err)
+	}
+	return true
+}
+
+// doLimits checks limits of new proxy request. If a limit is exceeded, it
+// responds rejection and returns true.
+func (ctx *Context) doLimits(w http.ResponseWriter, r *http.Request) bool {
+	l := ctx.Prx.Limits
+	if l == nil {
+		return false
+	}
+	ctx.limitKey = l.key(ctx)
+	tunnel := r.Method == "CONNECT"
+	if err := l.acquire(ctx.limitKey, tunnel); err != nil {
+		if r.Body != nil {
+			defer r.Body.Close()
+		}
+		ctx.doError("Limit", ErrLimitExceeded, err)
+		if err := ctx.serveLimitRejection(w); err != nil && !isConnectionClosed(err) {
+			ctx.doError("Limit", ErrResponseWrite, err)
+		}
+		return true
+	}
+	ctx.limitTunnel = tunnel
+	return false
+}
+
+// doMitmLimits checks limits of MITM request. If a limit is exceeded, it
+// responds rejection and returns true with error of response.
+func (ctx *Context) doMitmLimits(w http.ResponseWriter, r *http.Request) (bool, error) {
+	l := ctx.Prx.Limits
+	if l == nil {
+		return false, nil
+	}
+	if err := l.acquireMitmRequest(ctx.limitKey); err != nil {
+		if r.Body != nil {
+			defer r.Body.Close()
+		}
+		ctx.doError("Limit", ErrLimitExceeded, err)
+		err := ctx.serveLimitRejection(w)
+		ctx.doTunnelError("Limit", ErrResponseWrite, err)
+		return true, err
+	}
+	ctx.limitMitm = true
+	return false, nil
+}
+
+func (ctx *Context) releaseMitmLimits() {
+	if ctx.limitMitm {
+		ctx.limitMitm = false
+		ctx.Prx.Limits.releaseMitmRequest(ctx.limitKey)
+	}
+}
+
+func (ctx *Context) releaseLimits() {
+	if ctx.limitTunnel {
+		ctx.limitTunnel = false
+		ctx.Prx.Limits.releaseTunnel(ctx.limitKey)
+	}
+}
+
+func (ctx *Context) serveLimitRejection(w http.ResponseWriter) error {
+	code := ctx.Prx.Limits.RejectStatusCode
+	if code == 0 {
+		code = http.StatusTooManyRequests
+	}
+	header := map[string][]string{"Retry-After": {"1"}}
+	return ServeInMemory(w, code, header, []byte(http.StatusText(code)))
+}
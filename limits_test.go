@@ -0,0 +1,205 @@
+package httpproxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestLimitsTunnels(t *testing.T) {
+	l := &Limits{MaxTunnels: 2}
+	for i := 0; i < 2; i++ {
+		if err := l.acquire("a", true); err != nil {
+			t.Fatalf("tunnel %d: %v", i+1, err)
+		}
+	}
+	if err := l.acquire("a", true); err != errLimitTunnels {
+		t.Errorf("tunnel over limit: %v, want %v", err, errLimitTunnels)
+	}
+	if err := l.acquire("a", false); err != nil {
+		t.Errorf("request over tunnel limit: %v", err)
+	}
+	if err := l.acquire("b", true); err != nil {
+		t.Errorf("tunnel of other client: %v", err)
+	}
+	l.releaseTunnel("a")
+	if err := l.acquire("a", true); err != nil {
+		t.Errorf("tunnel after release: %v", err)
+	}
+	l.releaseTunnel("a")
+	l.releaseTunnel("a")
+	l.releaseTunnel("b")
+	if len(l.clients) != 0 {
+		t.Errorf("%d clients kept after release", len(l.clients))
+	}
+}
+
+func TestLimitsMitmRequests(t *testing.T) {
+	l := &Limits{MaxMitmRequests: 1}
+	if err := l.acquireMitmRequest("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquireMitmRequest("a"); err != errLimitMitmRequests {
+		t.Errorf("MITM request over limit: %v, want %v", err, errLimitMitmRequests)
+	}
+	if err := l.acquireMitmRequest("b"); err != nil {
+		t.Errorf("MITM request of other client: %v", err)
+	}
+	l.releaseMitmRequest("a")
+	if err := l.acquireMitmRequest("a"); err != nil {
+		t.Errorf("MITM request after release: %v", err)
+	}
+	l.releaseMitmRequest("a")
+	l.releaseMitmRequest("b")
+	if len(l.clients) != 0 {
+		t.Errorf("%d clients kept after release", len(l.clients))
+	}
+}
+
+func TestLimitsRequestRate(t *testing.T) {
+	l := &Limits{RequestsPerSecond: 20, RequestsBurst: 3}
+	for i := 0; i < 3; i++ {
+		if err := l.acquire("a", i == 0); err != nil {
+			t.Fatalf("request %d in burst: %v", i+1, err)
+		}
+	}
+	if err := l.acquire("a", false); err != errLimitRequestRate {
+		t.Errorf("request over burst: %v, want %v", err, errLimitRequestRate)
+	}
+	if err := l.acquire("b", false); err != nil {
+		t.Errorf("request of other client: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := l.acquire("a", false); err != nil {
+		t.Errorf("request after refill: %v", err)
+	}
+	if err := l.acquire("a", false); err != errLimitRequestRate {
+		t.Errorf("request over rate: %v, want %v", err, errLimitRequestRate)
+	}
+}
+
+func TestLimitsConnectionRate(t *testing.T) {
+	l := &Limits{ConnectionsPerSecond: 20, ConnectionsBurst: 2}
+	for i, key := range []string{"1", "2"} {
+		if l.connState(key, "192.0.2.1", http.StateNew); l.connRejected(key) {
+			t.Fatalf("connection %d in burst is rejected", i+1)
+		}
+	}
+	if l.connState("3", "192.0.2.1", http.StateNew); !l.connRejected("3") {
+		t.Error("connection over burst isn't rejected")
+	}
+	if l.connState("4", "192.0.2.2", http.StateNew); l.connRejected("4") {
+		t.Error("connection of other client is rejected")
+	}
+	l.connState("3", "192.0.2.1", http.StateClosed)
+	if l.connRejected("3") || len(l.rejected) != 0 {
+		t.Errorf("%d connections kept rejected after close", len(l.rejected))
+	}
+	time.Sleep(60 * time.Millisecond)
+	if l.connState("5", "192.0.2.1", http.StateNew); l.connRejected("5") {
+		t.Error("connection after refill is rejected")
+	}
+
+	// Full buckets are swept.
+	l.mu.Lock()
+	l.sweep(time.Now().Add(time.Hour))
+	n := len(l.conns)
+	l.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d buckets kept after sweep", n)
+	}
+}
+
+// newTestLimitsProxy returns a proxy server with limits and an origin server.
+func newTestLimitsProxy(t *testing.T, limits *Limits) (srv *httptest.Server, origin *httptest.Server) {
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prx.Rt = &http.Transport{}
+	prx.Limits = limits
+	srv = httptest.NewUnstartedServer(prx)
+	srv.Config.ConnState = prx.ConnState
+	srv.Start()
+	return srv, origin
+}
+
+func TestLimitsProxyConnectionRate(t *testing.T) {
+	srv, origin := newTestLimitsProxy(t, &Limits{ConnectionsPerSecond: 0.001, ConnectionsBurst: 2, RejectStatusCode: http.StatusServiceUnavailable})
+	defer srv.Close()
+	defer origin.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		want := http.StatusOK
+		if i == 2 {
+			want = http.StatusServiceUnavailable
+		}
+		if resp.StatusCode != want {
+			t.Errorf("connection %d: status %d, want %d", i+1, resp.StatusCode, want)
+		}
+		if i == 2 && (!resp.Close || resp.Header.Get("Retry-After") != "1") {
+			t.Errorf("rejected connection: close %v, Retry-After %q", resp.Close, resp.Header.Get("Retry-After"))
+		}
+	}
+}
+
+func TestLimitsProxyTunnels(t *testing.T) {
+	srv, origin := newTestLimitsProxy(t, &Limits{MaxTunnels: 1})
+	defer srv.Close()
+	defer origin.Close()
+	host := origin.Listener.Addr().String()
+	connect := func() (net.Conn, int) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, resp.StatusCode
+	}
+
+	conn, code := connect()
+	if code != http.StatusOK {
+		t.Fatalf("tunnel: status %d", code)
+	}
+	conn2, code := connect()
+	conn2.Close()
+	if code != http.StatusTooManyRequests {
+		t.Errorf("tunnel over limit: status %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	// Tunnel is released when it's closed.
+	conn.Close()
+	for i := 0; ; i++ {
+		conn, code = connect()
+		conn.Close()
+		if code == http.StatusOK {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("tunnel after close: status %d", code)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,189 @@
+package httpproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// First file descriptor passed by socket activation protocol.
+const listenFdsStart = 3
+
+// inheritedListener is a listener passed by parent process.
+type inheritedListener struct {
+	l    net.Listener
+	name string
+	used bool
+}
+
+var inherited struct {
+	once      sync.Once
+	mu        sync.Mutex
+	listeners []*inheritedListener
+	err       error
+}
+
+// listenFdsForProcess checks listeners of environment are passed to this
+// process. Systemd sets LISTEN_PID to PID of the process, and StartProcess
+// sets LISTEN_PPID to PID of its parent instead, because it can't know PID of
+// the process before it starts.
+func listenFdsForProcess() bool {
+	if pid := os.Getenv("LISTEN_PID"); pid != "" {
+		return pid == strconv.Itoa(os.Getpid())
+	}
+	ppid := os.Getenv("LISTEN_PPID")
+	return ppid != "" && ppid == strconv.Itoa(os.Getppid())
+}
+
+// loadInheritedListeners loads listeners passed by systemd-style socket
+// activation once. Environment variables of the protocol are unset, so child
+// processes don't inherit them.
+func loadInheritedListeners() {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_PPID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	if !listenFdsForProcess() {
+		return
+	}
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		inherited.err = fmt.Errorf("invalid LISTEN_FDS %q", fds)
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		f := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			inherited.err = fmt.Errorf("listen fd %d: %v", fd, err)
+			return
+		}
+		il := &inheritedListener{l: l}
+		if i < len(names) {
+			il.name = names[i]
+		}
+		inherited.listeners = append(inherited.listeners, il)
+	}
+}
+
+// InheritedListeners returns listeners passed by systemd-style socket
+// activation (LISTEN_FDS) or by StartProcess of parent process, which aren't
+// returned by Listen yet.
+func InheritedListeners() ([]net.Listener, error) {
+	inherited.once.Do(loadInheritedListeners)
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	var ls []net.Listener
+	for _, il := range inherited.listeners {
+		if !il.used {
+			il.used = true
+			ls = append(ls, il.l)
+		}
+	}
+	return ls, inherited.err
+}
+
+// Listen returns listener passed by systemd-style socket activation or by
+// StartProcess of parent process, which has the address or the name addr.
+// If there is no such listener, it returns net.Listen(network, addr).
+func Listen(network string, addr string) (net.Listener, error) {
+	inherited.once.Do(loadInheritedListeners)
+	if inherited.err != nil {
+		return nil, inherited.err
+	}
+	inherited.mu.Lock()
+	for _, il := range inherited.listeners {
+		if !il.used && (il.name == addr || sameListenAddr(il.l.Addr(), network, addr)) {
+			il.used = true
+			inherited.mu.Unlock()
+			return il.l, nil
+		}
+	}
+	inherited.mu.Unlock()
+	return net.Listen(network, addr)
+}
+
+// sameListenAddr checks the listener address a is network address addr.
+func sameListenAddr(a net.Addr, network string, addr string) bool {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		if !strings.HasPrefix(network, "tcp") {
+			return false
+		}
+		b, err := net.ResolveTCPAddr(network, addr)
+		if err != nil || b.Port == 0 || a.Port != b.Port {
+			return false
+		}
+		if len(b.IP) == 0 || b.IP.IsUnspecified() {
+			return len(a.IP) == 0 || a.IP.IsUnspecified()
+		}
+		return a.IP.Equal(b.IP)
+	case *net.UnixAddr:
+		return strings.HasPrefix(network, "unix") && a.Name == addr
+	}
+	return false
+}
+
+// StartProcess starts a new process of the running executable by the same
+// arguments and passes listeners to it by socket activation protocol, so new
+// process can take them over by Listen. After it returns, old process should
+// stop accepting, e.g. by closing listeners or http.Server.Shutdown, and drain
+// connections by Proxy.Shutdown. Accepting continues without downtime because
+// listening sockets are shared by both processes.
+//
+// Unlike systemd, it sets LISTEN_PPID to PID of the running process instead of
+// LISTEN_PID, which can't be known before new process starts. So only this
+// package accepts the listeners, and other implementations ignore them.
+func StartProcess(listeners ...net.Listener) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, errors.New("listener doesn't support file: " + l.Addr().String())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "LISTEN_PID=") && !strings.HasPrefix(e, "LISTEN_PPID=") &&
+			!strings.HasPrefix(e, "LISTEN_FDS=") && !strings.HasPrefix(e, "LISTEN_FDNAMES=") {
+			env = append(env, e)
+		}
+	}
+	env = append(env, "LISTEN_PPID="+strconv.Itoa(os.Getpid()), "LISTEN_FDS="+strconv.Itoa(len(files)))
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, nil
+}
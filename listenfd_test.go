@@ -0,0 +1,123 @@
+package httpproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Process started by TestStartProcess serves a connection by listener
+	// passed to it.
+	if os.Getenv("HTTPPROXY_TEST_START_PROCESS") != "" {
+		os.Exit(startProcessChild())
+	}
+	os.Exit(m.Run())
+}
+
+func startProcessChild() int {
+	l, err := Listen("tcp", os.Getenv("HTTPPROXY_TEST_START_PROCESS"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "%d %q\n", os.Getpid(), os.Getenv("LISTEN_FDS")+os.Getenv("LISTEN_PPID"))
+	return 0
+}
+
+func TestStartProcess(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	t.Setenv("HTTPPROXY_TEST_START_PROCESS", l.Addr().String())
+	p, err := StartProcess(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Wait()
+	defer p.Kill()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Child accepted the connection by inherited listener, and unset
+	// environment variables of the protocol.
+	if want := strconv.Itoa(p.Pid) + ` ""` + "\n"; line != want {
+		t.Errorf("child wrote %q, want %q", line, want)
+	}
+}
+
+func TestListenFdsForProcess(t *testing.T) {
+	pid, ppid := strconv.Itoa(os.Getpid()), strconv.Itoa(os.Getppid())
+	tests := []struct {
+		pid  string
+		ppid string
+		want bool
+	}{
+		{"", "", false},
+		{pid, "", true},
+		{"1", "", false},
+		{"", ppid, true},
+		{"", "1", false},
+		{"1", ppid, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("LISTEN_PID", tt.pid)
+		t.Setenv("LISTEN_PPID", tt.ppid)
+		if got := listenFdsForProcess(); got != tt.want {
+			t.Errorf("LISTEN_PID=%q LISTEN_PPID=%q: %v, want %v", tt.pid, tt.ppid, got, tt.want)
+		}
+	}
+}
+
+func TestSameListenAddr(t *testing.T) {
+	tcp := func(s string) net.Addr {
+		a, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	tests := []struct {
+		a       net.Addr
+		network string
+		addr    string
+		want    bool
+	}{
+		{tcp("127.0.0.1:8080"), "tcp", "127.0.0.1:8080", true},
+		{tcp("127.0.0.1:8080"), "tcp4", "127.0.0.1:8080", true},
+		{tcp("127.0.0.1:8080"), "tcp", "127.0.0.1:8081", false},
+		{tcp("127.0.0.1:8080"), "tcp", "127.0.0.2:8080", false},
+		{tcp("127.0.0.1:8080"), "tcp", ":8080", false},
+		{tcp("[::]:8080"), "tcp", ":8080", true},
+		{tcp("0.0.0.0:8080"), "tcp", "0.0.0.0:8080", true},
+		{tcp("127.0.0.1:8080"), "unix", "127.0.0.1:8080", false},
+		{tcp("127.0.0.1:0"), "tcp", "127.0.0.1:0", false},
+		{&net.UnixAddr{Name: "/run/proxy.sock", Net: "unix"}, "unix", "/run/proxy.sock", true},
+		{&net.UnixAddr{Name: "/run/proxy.sock", Net: "unix"}, "unix", "/run/other.sock", false},
+	}
+	for _, tt := range tests {
+		if got := sameListenAddr(tt.a, tt.network, tt.addr); got != tt.want {
+			t.Errorf("sameListenAddr(%v, %q, %q) = %v, want %v", tt.a, tt.network, tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package httpproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MirrorTransport is an http.RoundTripper that dials remote TLS connections
+// with TLS versions, curves and ALPN protocols of ClientHello observed from
+// client on ConnectMitm. Remote requests without ClientHello are sent by base
+// transport.
+//
+// It doesn't replay JA3 or JA4 fingerprint of client: crypto/tls chooses
+// cipher suite order, extension order and GREASE values itself, so remote
+// still sees a Go TLS client. To replay ClientHello byte for byte, set
+// Base.DialTLSContext to a dialer which can use ctx.ClientHello.Raw through
+// ProxyContext.
+type MirrorTransport struct {
+	// Base transport. It's cloned for each distinct ClientHello.
+	Base *http.Transport
+
+	transports transportCache
+}
+
+// NewMirrorTransport returns a new MirrorTransport given base transport. If base
+// is nil, it uses a clone of http.DefaultTransport.
+func NewMirrorTransport(base *http.Transport) *MirrorTransport {
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	return &MirrorTransport{Base: base}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *MirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := ProxyContext(req.Context())
+	if ctx == nil || req.URL.Scheme != "https" {
+		return t.Base.RoundTrip(req)
+	}
+	if ctx.ClientHello == nil && ctx.RemoteClientCert == nil {
+		return t.Base.RoundTrip(req)
+	}
+	return t.transport(ctx.ClientHello, ctx.RemoteClientCert).RoundTrip(req)
+}
+
+// CloseIdleConnections closes idle connections of all transports.
+func (t *MirrorTransport) CloseIdleConnections() {
+	t.Base.CloseIdleConnections()
+	t.transports.closeIdleConnections()
+}
+
+func (t *MirrorTransport) transport(hello *ClientHello, cert *tls.Certificate) *http.Transport {
+	key := certKey(cert)
+	if hello != nil {
+		key += "|" + ja3List(hello.SupportedVersions) + "|" + ja3List(hello.SupportedGroups) +
+			"|" + strconv.Itoa(int(hello.Version)) + "|" + strings.Join(hello.ALPNProtocols, ",")
+	}
+	return t.transports.get(key, func() *http.Transport {
+		tr := t.Base.Clone()
+		if hello != nil {
+			tr.TLSClientConfig = MirrorTLSConfig(t.Base.TLSClientConfig, hello)
+			tr.ForceAttemptHTTP2 = false
+			for _, p := range hello.ALPNProtocols {
+				if p == "h2" {
+					tr.ForceAttemptHTTP2 = true
+				}
+			}
+		}
+		if cert != nil {
+			withClientCert(tr, cert)
+		}
+		return tr
+	})
+}
+
+// MirrorTLSConfig returns a clone of base TLS config, or a new one if base is
+// nil, with TLS versions, curves and ALPN protocols of ClientHello. TLS
+// versions are kept in range of base, MinVersion defaults to TLS 1.2 like
+// crypto/tls; if versions of client are out of range, base versions stay.
+// Curves which crypto/tls doesn't support are skipped.
+func MirrorTLSConfig(base *tls.Config, hello *ClientHello) *tls.Config {
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	minVersion, maxVersion := uint16(tls.VersionTLS10), hello.Version
+	if versions := withoutGREASE(hello.SupportedVersions); len(versions) > 0 {
+		minVersion, maxVersion = versions[0], versions[0]
+		for _, v := range versions {
+			if v < minVersion {
+				minVersion = v
+			}
+			if v > maxVersion {
+				maxVersion = v
+			}
+		}
+	}
+	floor := cfg.MinVersion
+	if floor == 0 {
+		floor = tls.VersionTLS12
+	}
+	if minVersion < floor {
+		minVersion = floor
+	}
+	if cfg.MaxVersion != 0 && maxVersion > cfg.MaxVersion {
+		maxVersion = cfg.MaxVersion
+	}
+	if minVersion <= maxVersion {
+		cfg.MinVersion, cfg.MaxVersion = minVersion, maxVersion
+	}
+	var curves []tls.CurveID
+	for _, g := range hello.SupportedGroups {
+		switch c := tls.CurveID(g); c {
+		case tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521:
+			curves = append(curves, c)
+		}
+	}
+	if len(curves) > 0 {
+		cfg.CurvePreferences = curves
+	}
+	cfg.NextProtos = append([]string(nil), hello.ALPNProtocols...)
+	return cfg
+}
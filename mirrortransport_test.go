@@ -0,0 +1,101 @@
+package httpproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testHelloListener is a net.Listener which peeks ClientHello of accepted
+// connections.
+type testHelloListener struct {
+	net.Listener
+	hellos chan *ClientHello
+}
+
+func (l *testHelloListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	raw, hello, _ := peekClientHello(conn, 5*time.Second)
+	l.hellos <- hello
+	return &prefixConn{Conn: conn, prefix: raw}, nil
+}
+
+func TestMirrorTransport(t *testing.T) {
+	cert := testCertificate(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hl := &testHelloListener{Listener: l, hellos: make(chan *ClientHello, 1)}
+	origin := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "hello") }),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	go origin.ServeTLS(hl, "", "")
+	defer origin.Close()
+
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	prx.Rt = NewMirrorTransport(&http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}})
+	prx.OnConnect = func(ctx *Context, host string) (ConnectAction, string) {
+		return ConnectMitm, host
+	}
+	clientHellos := make(chan *ClientHello, 1)
+	prx.OnRequest = func(ctx *Context, req *http.Request) *http.Response {
+		clientHellos <- ctx.ClientHello
+		return nil
+	}
+	srv := httptest.NewServer(prx)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+
+	tests := []*tls.Config{
+		{MaxVersion: tls.VersionTLS12, CurvePreferences: []tls.CurveID{tls.CurveP384}, NextProtos: []string{"http/1.1"}},
+		{MinVersion: tls.VersionTLS12, CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256}, NextProtos: []string{"http/1.1"}},
+		{MinVersion: tls.VersionTLS13, CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384}},
+	}
+	for i, cfg := range tests {
+		cfg.InsecureSkipVerify = true
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: cfg}}
+		resp, err := client.Get("https://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		client.CloseIdleConnections()
+
+		// Mirrored parts of upstream ClientHello are the same as client's.
+		clientHello, originHello := <-clientHellos, <-hl.hellos
+		if clientHello == nil || originHello == nil {
+			t.Fatalf("%d: ClientHello of client %v, of proxy %v", i, clientHello, originHello)
+		}
+		if got, want := withoutGREASE(originHello.SupportedVersions), withoutGREASE(clientHello.SupportedVersions); !reflect.DeepEqual(got, want) {
+			t.Errorf("%d: supported versions %x, want %x", i, got, want)
+		}
+		if got, want := originHello.SupportedGroups, clientHello.SupportedGroups; !reflect.DeepEqual(got, want) {
+			t.Errorf("%d: supported groups %x, want %x", i, got, want)
+		}
+		if got, want := originHello.ALPNProtocols, clientHello.ALPNProtocols; !reflect.DeepEqual(got, want) {
+			t.Errorf("%d: ALPN protocols %q, want %q", i, got, want)
+		}
+		if got, want := originHello.JA4()[:4], clientHello.JA4()[:4]; got != want {
+			t.Errorf("%d: JA4 version and SNI %q, want %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package httpproxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+// Rotation period of MITM session ticket keys. Tickets encrypted by previous
+// key are still accepted for one more period.
+const sessionTicketKeyRotation = 24 * time.Hour
+
+// sessionTicketKeys keeps session ticket keys shared by all MITM sessions of a
+// proxy, so clients can resume sessions across connections.
+type sessionTicketKeys struct {
+	mu      sync.Mutex
+	keys    [][32]byte
+	rotated time.Time
+}
+
+func (k *sessionTicketKeys) get() [][32]byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	if k.keys == nil || now.Sub(k.rotated) >= sessionTicketKeyRotation {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return nil
+		}
+		k.keys = append([][32]byte{key}, k.keys...)
+		if len(k.keys) > 2 {
+			k.keys = k.keys[:2]
+		}
+		k.rotated = now
+	}
+	return k.keys
+}
+
+// mitmTLSConfig returns TLS server config of ConnectMitm given forged
+// certificate.
+func (ctx *Context) mitmTLSConfig(cert *tls.Certificate) *tls.Config {
+	tlsConfig := &tls.Config{}
+	if ctx.Prx.MitmTLSConfig != nil {
+		tlsConfig = ctx.Prx.MitmTLSConfig.Clone()
+	}
+	tlsConfig.Certificates = []tls.Certificate{*cert}
+	tlsConfig.GetCertificate = nil
+	if ctx.Prx.MitmClientAuth != tls.NoClientCert {
+		tlsConfig.ClientAuth = ctx.Prx.MitmClientAuth
+	}
+	if ctx.Prx.Pcap != nil {
+		tlsConfig.KeyLogWriter = ctx.Prx.Pcap.KeyLogWriter()
+	}
+	if !tlsConfig.SessionTicketsDisabled {
+		if keys := ctx.Prx.ticketKeys.get(); keys != nil {
+			tlsConfig.SetSessionTicketKeys(keys)
+		}
+	}
+	if ctx.Prx.OnMitmTLSConfig != nil {
+		ctx.onMitmTLSConfig(tlsConfig)
+	}
+	return tlsConfig
+}
@@ -0,0 +1,260 @@
+package httpproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// NTLM message types and flags used by proxy.
+const (
+	ntlmNegotiateMessage    = 1
+	ntlmChallengeMessage    = 2
+	ntlmAuthenticateMessage = 3
+
+	ntlmFlagUnicode          = 0x00000001
+	ntlmFlagRequestTarget    = 0x00000004
+	ntlmFlagNTLM             = 0x00000200
+	ntlmFlagAlwaysSign       = 0x00008000
+	ntlmFlagTargetTypeDomain = 0x00010000
+	ntlmFlagExtendedSecurity = 0x00080000
+	ntlmFlagTargetInfo       = 0x00800000
+	ntlmFlag128              = 0x20000000
+	ntlmFlag56               = 0x80000000
+)
+
+// NTLM AV_PAIR IDs of target info.
+const (
+	ntlmAvEOL             = 0
+	ntlmAvNbComputerName  = 1
+	ntlmAvNbDomainName    = 2
+	ntlmAvDNSComputerName = 3
+	ntlmAvDNSDomainName   = 4
+	ntlmAvTimestamp       = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// Errors of NTLM handshake.
+var (
+	errNTLMMessage     = errors.New("invalid NTLM message")
+	errNTLMv1          = errors.New("NTLMv1 response not accepted")
+	errNTLMUnknownUser = errors.New("unknown NTLM user")
+	errNTLMResponse    = errors.New("NTLM response mismatch")
+)
+
+// NTLMResponse is an NTLM authenticate message sent by client, with the
+// server challenge it responds to.
+type NTLMResponse struct {
+	User        string
+	Domain      string
+	Workstation string
+
+	// Challenge sent by proxy.
+	ServerChallenge []byte
+
+	// Target info sent by proxy in challenge.
+	TargetInfo []byte
+
+	// NtChallengeResponse and LmChallengeResponse of client.
+	NTResponse []byte
+	LMResponse []byte
+}
+
+// NTLMAuthenticator is a ConnAuthenticator of NTLM. It runs NTLM handshake
+// with client, and passes the response to Verify, e.g. a verifier of domain
+// controller or NTLMHashVerifier. Negotiate scheme is supported only for raw
+// NTLM tokens; SPNEGO wrapped tokens require another ConnAuthenticator.
+type NTLMAuthenticator struct {
+	// NetBIOS domain name sent in challenge.
+	Domain string
+
+	// NetBIOS computer name of proxy sent in challenge.
+	Computer string
+
+	// Authentication scheme, "NTLM" or "Negotiate".
+	// By default, "NTLM".
+	AuthScheme string
+
+	// Verify verifies response of client. If it returns nil, user is
+	// authenticated.
+	Verify func(ctx *Context, resp *NTLMResponse) error
+}
+
+// Scheme implements ConnAuthenticator.
+func (a *NTLMAuthenticator) Scheme() string {
+	if a.AuthScheme != "" {
+		return a.AuthScheme
+	}
+	return "NTLM"
+}
+
+// NewSession implements ConnAuthenticator.
+func (a *NTLMAuthenticator) NewSession(ctx *Context) ConnAuthSession {
+	return &ntlmSession{a: a}
+}
+
+type ntlmSession struct {
+	a          *NTLMAuthenticator
+	challenge  []byte
+	targetInfo []byte
+}
+
+// Step implements ConnAuthSession.
+func (s *ntlmSession) Step(ctx *Context, token []byte) (out []byte, user string, done bool, err error) {
+	if len(token) < 12 || !bytes.Equal(token[:8], ntlmSignature) {
+		return nil, "", false, errNTLMMessage
+	}
+	switch binary.LittleEndian.Uint32(token[8:]) {
+	case ntlmNegotiateMessage:
+		return s.challengeMessage(token), "", false, nil
+	case ntlmAuthenticateMessage:
+		if s.challenge == nil {
+			return nil, "", false, errNTLMMessage
+		}
+		resp, err := s.parseAuthenticate(token)
+		if err != nil {
+			return nil, "", false, err
+		}
+		if err := s.a.Verify(ctx, resp); err != nil {
+			return nil, "", false, err
+		}
+		user := resp.User
+		if resp.Domain != "" {
+			user = resp.Domain + `\` + user
+		}
+		return nil, user, true, nil
+	}
+	return nil, "", false, errNTLMMessage
+}
+
+// challengeMessage returns CHALLENGE_MESSAGE responds to NEGOTIATE_MESSAGE.
+func (s *ntlmSession) challengeMessage(negotiate []byte) []byte {
+	s.challenge = make([]byte, 8)
+	if _, err := rand.Read(s.challenge); err != nil {
+		panic(err)
+	}
+	flags := uint32(ntlmFlagUnicode | ntlmFlagRequestTarget | ntlmFlagNTLM | ntlmFlagAlwaysSign |
+		ntlmFlagTargetTypeDomain | ntlmFlagTargetInfo | ntlmFlag128 | ntlmFlag56)
+	if len(negotiate) >= 16 && binary.LittleEndian.Uint32(negotiate[12:])&ntlmFlagExtendedSecurity != 0 {
+		flags |= ntlmFlagExtendedSecurity
+	}
+	target := ntlmUnicode(strings.ToUpper(s.a.Domain))
+	var info bytes.Buffer
+	avPair := func(id uint16, value []byte) {
+		binary.Write(&info, binary.LittleEndian, id)
+		binary.Write(&info, binary.LittleEndian, uint16(len(value)))
+		info.Write(value)
+	}
+	avPair(ntlmAvNbDomainName, target)
+	avPair(ntlmAvNbComputerName, ntlmUnicode(strings.ToUpper(s.a.Computer)))
+	avPair(ntlmAvDNSDomainName, ntlmUnicode(strings.ToLower(s.a.Domain)))
+	avPair(ntlmAvDNSComputerName, ntlmUnicode(strings.ToLower(s.a.Computer)))
+	ts := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ts, uint64(time.Now().UnixNano()/100+116444736000000000))
+	avPair(ntlmAvTimestamp, ts)
+	avPair(ntlmAvEOL, nil)
+	s.targetInfo = info.Bytes()
+
+	const headerLen = 48
+	msg := make([]byte, headerLen, headerLen+len(target)+len(s.targetInfo))
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], ntlmChallengeMessage)
+	ntlmPutField(msg[12:], len(target), headerLen)
+	binary.LittleEndian.PutUint32(msg[20:], flags)
+	copy(msg[24:], s.challenge)
+	ntlmPutField(msg[40:], len(s.targetInfo), headerLen+len(target))
+	msg = append(msg, target...)
+	return append(msg, s.targetInfo...)
+}
+
+// parseAuthenticate parses AUTHENTICATE_MESSAGE.
+func (s *ntlmSession) parseAuthenticate(msg []byte) (*NTLMResponse, error) {
+	if len(msg) < 64 {
+		return nil, errNTLMMessage
+	}
+	field := func(off int) ([]byte, error) {
+		l := int(binary.LittleEndian.Uint16(msg[off:]))
+		o := int(binary.LittleEndian.Uint32(msg[off+4:]))
+		if o > len(msg) || l > len(msg)-o {
+			return nil, errNTLMMessage
+		}
+		return msg[o : o+l], nil
+	}
+	var fields [5][]byte
+	for i := range fields {
+		var err error
+		if fields[i], err = field(12 + i*8); err != nil {
+			return nil, err
+		}
+	}
+	unicode := binary.LittleEndian.Uint32(msg[60:])&ntlmFlagUnicode != 0
+	str := func(b []byte) string {
+		if !unicode {
+			return string(b)
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(b[i*2:])
+		}
+		return string(utf16.Decode(u))
+	}
+	return &NTLMResponse{
+		LMResponse:      fields[0],
+		NTResponse:      fields[1],
+		Domain:          str(fields[2]),
+		User:            str(fields[3]),
+		Workstation:     str(fields[4]),
+		ServerChallenge: s.challenge,
+		TargetInfo:      s.targetInfo,
+	}, nil
+}
+
+// NTLMHashVerifier returns a verifier of NTLMv2 responses for
+// NTLMAuthenticator.Verify. lookup returns NT hash (MD4 of UTF-16LE
+// password) of user in domain, so plaintext passwords are never stored.
+// NTLMv1 responses are rejected.
+func NTLMHashVerifier(lookup func(user string, domain string) (ntHash []byte, ok bool)) func(ctx *Context, resp *NTLMResponse) error {
+	return func(ctx *Context, resp *NTLMResponse) error {
+		if len(resp.NTResponse) <= 24 {
+			return errNTLMv1
+		}
+		ntHash, ok := lookup(resp.User, resp.Domain)
+		if !ok {
+			return errNTLMUnknownUser
+		}
+		h := hmac.New(md5.New, ntHash)
+		h.Write(ntlmUnicode(strings.ToUpper(resp.User) + resp.Domain))
+		ntowf := h.Sum(nil)
+		h = hmac.New(md5.New, ntowf)
+		h.Write(resp.ServerChallenge)
+		h.Write(resp.NTResponse[16:])
+		if !hmac.Equal(h.Sum(nil), resp.NTResponse[:16]) {
+			return errNTLMResponse
+		}
+		return nil
+	}
+}
+
+// ntlmUnicode returns UTF-16LE encoding of s.
+func ntlmUnicode(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	return b
+}
+
+// ntlmPutField puts length, max length and offset of a payload field.
+func ntlmPutField(b []byte, length int, offset int) {
+	binary.LittleEndian.PutUint16(b, uint16(length))
+	binary.LittleEndian.PutUint16(b[2:], uint16(length))
+	binary.LittleEndian.PutUint32(b[4:], uint32(offset))
+}
@@ -0,0 +1,217 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// ntlmTestClientBlob returns temp of NTLMv2 response given client challenge
+// and target info, with zero timestamp.
+func ntlmTestClientBlob(clientChallenge []byte, targetInfo []byte) []byte {
+	blob := []byte{1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	blob = append(blob, clientChallenge...)
+	blob = append(blob, 0, 0, 0, 0)
+	blob = append(blob, targetInfo...)
+	return append(blob, 0, 0, 0, 0)
+}
+
+func TestNTLMHashVerifier(t *testing.T) {
+	// Known answer of NTLMv2 authentication of MS-NLMP 4.2.4.
+	ntHash := mustHex("a4f49c406510bdcab6824ee7c30fd852") // NTOWFv1("Password")
+	targetInfo := mustHex("02000c0044006f006d00610069006e00" + "01000c005300650072007600650072000000" + "0000")
+	resp := &NTLMResponse{
+		User:            "User",
+		Domain:          "Domain",
+		ServerChallenge: mustHex("0123456789abcdef"),
+		NTResponse: append(mustHex("68cd0ab851e51c96aabc927bebef6a1c"),
+			ntlmTestClientBlob(mustHex("aaaaaaaaaaaaaaaa"), targetInfo)...),
+	}
+	lookup := func(user string, domain string) ([]byte, bool) {
+		if user == "User" && domain == "Domain" {
+			return ntHash, true
+		}
+		return nil, false
+	}
+	verify := NTLMHashVerifier(lookup)
+	if err := verify(nil, resp); err != nil {
+		t.Errorf("known answer: %v", err)
+	}
+
+	wrong := *resp
+	wrong.ServerChallenge = mustHex("0123456789abcdee")
+	if err := verify(nil, &wrong); err != errNTLMResponse {
+		t.Errorf("other challenge: %v, want %v", err, errNTLMResponse)
+	}
+	wrong = *resp
+	wrong.User = "Other"
+	if err := verify(nil, &wrong); err != errNTLMUnknownUser {
+		t.Errorf("unknown user: %v, want %v", err, errNTLMUnknownUser)
+	}
+	wrong = *resp
+	wrong.NTResponse = resp.NTResponse[:24]
+	if err := verify(nil, &wrong); err != errNTLMv1 {
+		t.Errorf("NTLMv1: %v, want %v", err, errNTLMv1)
+	}
+}
+
+// ntlmTestAuthenticate returns AUTHENTICATE_MESSAGE of NTLMv2 responding
+// CHALLENGE_MESSAGE given NT hash.
+func ntlmTestAuthenticate(t *testing.T, challenge []byte, user string, domain string, ntHash []byte) []byte {
+	field := func(off int) []byte {
+		l := int(binary.LittleEndian.Uint16(challenge[off:]))
+		o := int(binary.LittleEndian.Uint32(challenge[off+4:]))
+		return challenge[o : o+l]
+	}
+	if len(challenge) < 48 || !bytes.Equal(challenge[:8], ntlmSignature) ||
+		binary.LittleEndian.Uint32(challenge[8:]) != ntlmChallengeMessage {
+		t.Fatalf("invalid challenge message %x", challenge)
+	}
+	h := hmac.New(md5.New, ntHash)
+	h.Write(ntlmUnicode(strings.ToUpper(user) + domain))
+	h = hmac.New(md5.New, h.Sum(nil))
+	blob := ntlmTestClientBlob([]byte("client!!"), field(40))
+	h.Write(challenge[24:32])
+	h.Write(blob)
+	ntResponse := append(h.Sum(nil), blob...)
+
+	payloads := [][]byte{make([]byte, 24), ntResponse, ntlmUnicode(domain), ntlmUnicode(user), nil}
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], ntlmAuthenticateMessage)
+	binary.LittleEndian.PutUint32(msg[60:], ntlmFlagUnicode|ntlmFlagNTLM)
+	for i, p := range payloads {
+		ntlmPutField(msg[12+i*8:], len(p), len(msg))
+		msg = append(msg, p...)
+	}
+	return msg
+}
+
+func TestNTLMAuthenticator(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+	ntHash := mustHex("a4f49c406510bdcab6824ee7c30fd852")
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prx.Rt = &http.Transport{}
+	prx.ConnAuth = &NTLMAuthenticator{Domain: "Domain", Computer: "Proxy",
+		Verify: NTLMHashVerifier(func(user string, domain string) ([]byte, bool) {
+			return ntHash, user == "User"
+		})}
+	var users []string
+	prx.OnRequest = func(ctx *Context, req *http.Request) *http.Response {
+		users = append(users, ctx.AuthUser)
+		return nil
+	}
+	srv := httptest.NewUnstartedServer(prx)
+	srv.Config.ConnState = prx.ConnState
+	srv.Start()
+	defer srv.Close()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	get := func(conn net.Conn, r *bufio.Reader, auth []byte) *http.Response {
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		if auth != nil {
+			req.Header.Set("Proxy-Authorization", "NTLM "+base64.StdEncoding.EncodeToString(auth))
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	conn, r := dial()
+	defer conn.Close()
+	negotiate := append(append([]byte(nil), ntlmSignature...), 1, 0, 0, 0, 0x07, 0x82, 0x08, 0xa2)
+	resp := get(conn, r, negotiate)
+	challenge, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(resp.Header.Get("Proxy-Authenticate"), "NTLM "))
+	if resp.StatusCode != http.StatusProxyAuthRequired || err != nil {
+		t.Fatalf("negotiate: status %d, challenge %q", resp.StatusCode, resp.Header.Get("Proxy-Authenticate"))
+	}
+	if resp := get(conn, r, ntlmTestAuthenticate(t, challenge, "User", "Domain", ntHash)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("authenticate: status %d", resp.StatusCode)
+	}
+	if resp := get(conn, r, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("authenticated connection: status %d", resp.StatusCode)
+	}
+	if want := []string{`Domain\User`, `Domain\User`}; strings.Join(users, ",") != strings.Join(want, ",") {
+		t.Errorf("users = %q, want %q", users, want)
+	}
+
+	// Another connection isn't authenticated.
+	conn2, r2 := dial()
+	defer conn2.Close()
+	if resp := get(conn2, r2, nil); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("new connection: status %d", resp.StatusCode)
+	}
+
+	// A wrong password fails the handshake.
+	resp = get(conn2, r2, negotiate)
+	challenge, _ = base64.StdEncoding.DecodeString(strings.TrimPrefix(resp.Header.Get("Proxy-Authenticate"), "NTLM "))
+	if resp := get(conn2, r2, ntlmTestAuthenticate(t, challenge, "User", "Domain", make([]byte, 16))); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("wrong password: status %d", resp.StatusCode)
+	}
+}
+
+func TestNTLMAuthenticatorWithoutConnState(t *testing.T) {
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prx.ConnAuth = &NTLMAuthenticator{Domain: "Domain", Computer: "Proxy",
+		Verify: func(ctx *Context, resp *NTLMResponse) error { return nil }}
+	var errs []*Error
+	prx.OnError = func(ctx *Context, where string, err *Error, opErr error) { errs = append(errs, err) }
+	srv := httptest.NewServer(prx)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.WriteProxy(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || len(errs) != 1 || errs[0] != ErrAuthScheme {
+		t.Errorf("status %d, errors %v, want 500 and %v", resp.StatusCode, errs, ErrAuthScheme)
+	}
+}
@@ -0,0 +1,294 @@
+package httpproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Constants of pcapng block types and fields.
+const (
+	pcapngBlockSHB         = 0x0A0D0D0A
+	pcapngBlockIDB         = 0x00000001
+	pcapngBlockEPB         = 0x00000006
+	pcapngBlockDSB         = 0x0000000A
+	pcapngByteOrderMagic   = 0x1A2B3C4D
+	pcapngLinkTypeRaw      = 101
+	pcapngSecretsTLSKeyLog = 0x544c534b
+	pcapngMaxSegmentSize   = 16384
+	pcapngTCPFlagFIN       = 0x01
+	pcapngTCPFlagSYN       = 0x02
+	pcapngTCPFlagPSH       = 0x08
+	pcapngTCPFlagACK       = 0x10
+	pcapngTCPHeaderLen     = 20
+	pcapngIPv4HeaderLen    = 20
+	pcapngIPv6HeaderLen    = 40
+	pcapngTCPWindow        = 65535
+)
+
+// PcapngWriter writes proxied traffic in pcapng format to open in Wireshark.
+// Traffic is written as synthesized TCP streams over raw IP, so it doesn't
+// require capturing on the wire. It's safe for concurrent use.
+type PcapngWriter struct {
+	w       io.Writer
+	mu      sync.Mutex
+	err     error
+	started bool
+}
+
+// NewPcapngWriter returns a new PcapngWriter writes to w.
+func NewPcapngWriter(w io.Writer) *PcapngWriter {
+	return &PcapngWriter{w: w}
+}
+
+// Err returns the first error occurred while writing, if any.
+func (p *PcapngWriter) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// KeyLogWriter returns an io.Writer to use as tls.Config.KeyLogWriter. Each
+// key log line written is embedded in a Decryption Secrets Block, so Wireshark
+// can decrypt TLS traffic in the same or merged captures.
+func (p *PcapngWriter) KeyLogWriter() io.Writer {
+	return pcapngKeyLogWriter{p}
+}
+
+// NewStream returns a new PcapngStream between client and server addresses.
+// It writes a synthesized TCP handshake immediately.
+func (p *PcapngWriter) NewStream(client, server net.Addr) *PcapngStream {
+	s := &PcapngStream{p: p}
+	s.addr[DirectionUpstream] = pcapngTCPAddr(client)
+	s.addr[DirectionDownstream] = pcapngTCPAddr(server)
+	src, dst := s.addr[DirectionUpstream], s.addr[DirectionDownstream]
+	if (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		s.addr[DirectionUpstream].IP = src.IP.To16()
+		s.addr[DirectionDownstream].IP = dst.IP.To16()
+		s.ipv6 = true
+	} else {
+		s.ipv6 = src.IP.To4() == nil
+	}
+	s.seq[DirectionUpstream] = uint32(time.Now().UnixNano())
+	s.seq[DirectionDownstream] = s.seq[DirectionUpstream] ^ 0x5a5a5a5a
+	s.segment(DirectionUpstream, pcapngTCPFlagSYN, nil)
+	s.seq[DirectionUpstream]++
+	s.segment(DirectionDownstream, pcapngTCPFlagSYN|pcapngTCPFlagACK, nil)
+	s.seq[DirectionDownstream]++
+	s.segment(DirectionUpstream, pcapngTCPFlagACK, nil)
+	return s
+}
+
+func (p *PcapngWriter) writeBlock(blockType uint32, body []byte) {
+	if p.err != nil {
+		return
+	}
+	if !p.started {
+		p.started = true
+		shb := make([]byte, 16)
+		binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+		binary.LittleEndian.PutUint16(shb[4:], 1)
+		binary.LittleEndian.PutUint16(shb[6:], 0)
+		binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+		p.writeBlock(pcapngBlockSHB, shb)
+		idb := make([]byte, 8)
+		binary.LittleEndian.PutUint16(idb[0:], pcapngLinkTypeRaw)
+		binary.LittleEndian.PutUint32(idb[4:], 0)
+		p.writeBlock(pcapngBlockIDB, idb)
+	}
+	padded := (len(body) + 3) &^ 3
+	buf := make([]byte, 12+padded)
+	binary.LittleEndian.PutUint32(buf[0:], blockType)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(buf)))
+	copy(buf[8:], body)
+	binary.LittleEndian.PutUint32(buf[len(buf)-4:], uint32(len(buf)))
+	if _, err := p.w.Write(buf); err != nil {
+		p.err = err
+	}
+}
+
+func (p *PcapngWriter) writePacket(ts time.Time, pkt []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	usec := uint64(ts.UnixNano() / 1000)
+	padded := (len(pkt) + 3) &^ 3
+	body := make([]byte, 20+padded)
+	binary.LittleEndian.PutUint32(body[0:], 0)
+	binary.LittleEndian.PutUint32(body[4:], uint32(usec>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(usec))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(pkt)))
+	copy(body[20:], pkt)
+	p.writeBlock(pcapngBlockEPB, body)
+}
+
+func (p *PcapngWriter) writeSecrets(secretsType uint32, data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	padded := (len(data) + 3) &^ 3
+	body := make([]byte, 8+padded)
+	binary.LittleEndian.PutUint32(body[0:], secretsType)
+	binary.LittleEndian.PutUint32(body[4:], uint32(len(data)))
+	copy(body[8:], data)
+	p.writeBlock(pcapngBlockDSB, body)
+}
+
+type pcapngKeyLogWriter struct {
+	p *PcapngWriter
+}
+
+func (k pcapngKeyLogWriter) Write(b []byte) (int, error) {
+	k.p.writeSecrets(pcapngSecretsTLSKeyLog, b)
+	return len(b), k.p.Err()
+}
+
+// PcapngStream is a synthesized TCP stream written by PcapngWriter. It's safe
+// for concurrent use.
+type PcapngStream struct {
+	p      *PcapngWriter
+	mu     sync.Mutex
+	addr   [2]*net.TCPAddr
+	seq    [2]uint32
+	closed [2]bool
+	ipv6   bool
+}
+
+// Write writes data as TCP segments sent in the given direction.
+func (s *PcapngStream) Write(dir Direction, b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed[dir] {
+		return
+	}
+	for len(b) > 0 {
+		n := len(b)
+		if n > pcapngMaxSegmentSize {
+			n = pcapngMaxSegmentSize
+		}
+		s.segment(dir, pcapngTCPFlagPSH|pcapngTCPFlagACK, b[:n])
+		s.seq[dir] += uint32(n)
+		b = b[n:]
+	}
+}
+
+// CloseWrite writes a TCP FIN sent in the given direction.
+func (s *PcapngStream) CloseWrite(dir Direction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed[dir] {
+		return
+	}
+	s.closed[dir] = true
+	s.segment(dir, pcapngTCPFlagFIN|pcapngTCPFlagACK, nil)
+	s.seq[dir]++
+}
+
+// Close writes TCP FINs for both directions, if they aren't written yet.
+func (s *PcapngStream) Close() {
+	s.CloseWrite(DirectionUpstream)
+	s.CloseWrite(DirectionDownstream)
+}
+
+func (s *PcapngStream) segment(dir Direction, flags byte, payload []byte) {
+	src, dst := s.addr[dir], s.addr[1-dir]
+	tcp := make([]byte, pcapngTCPHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], s.seq[dir])
+	if flags&pcapngTCPFlagACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], s.seq[1-dir])
+	}
+	tcp[12] = (pcapngTCPHeaderLen / 4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], pcapngTCPWindow)
+	copy(tcp[pcapngTCPHeaderLen:], payload)
+	var pkt, pseudo []byte
+	if s.ipv6 {
+		pkt = make([]byte, pcapngIPv6HeaderLen+len(tcp))
+		pkt[0] = 6 << 4
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(tcp)))
+		pkt[6] = 6
+		pkt[7] = 64
+		copy(pkt[8:], src.IP.To16())
+		copy(pkt[24:], dst.IP.To16())
+		pseudo = make([]byte, 40)
+		copy(pseudo[0:], pkt[8:40])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+		pseudo[39] = 6
+	} else {
+		pkt = make([]byte, pcapngIPv4HeaderLen+len(tcp))
+		pkt[0] = 4<<4 | pcapngIPv4HeaderLen/4
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(pkt[6:], 0x4000)
+		pkt[8] = 64
+		pkt[9] = 6
+		copy(pkt[12:], src.IP.To4())
+		copy(pkt[16:], dst.IP.To4())
+		binary.BigEndian.PutUint16(pkt[10:], inetChecksum(0, pkt[:pcapngIPv4HeaderLen]))
+		pseudo = make([]byte, 12)
+		copy(pseudo[0:], pkt[12:20])
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	}
+	binary.BigEndian.PutUint16(tcp[16:], inetChecksum(inetSum(0, pseudo), tcp))
+	copy(pkt[len(pkt)-len(tcp):], tcp)
+	s.p.writePacket(time.Now(), pkt)
+}
+
+// pcapngConn is a net.Conn records data passing through it to PcapngStream.
+// Read data is recorded as upstream, written data as downstream.
+type pcapngConn struct {
+	net.Conn
+	s *PcapngStream
+}
+
+func (c *pcapngConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.s.Write(DirectionUpstream, b[:n])
+	}
+	return n, err
+}
+
+func (c *pcapngConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.s.Write(DirectionDownstream, b[:n])
+	}
+	return n, err
+}
+
+func pcapngTCPAddr(addr net.Addr) *net.TCPAddr {
+	rv := &net.TCPAddr{IP: net.IPv4zero}
+	if addr == nil {
+		return rv
+	}
+	if a, ok := addr.(*net.TCPAddr); ok && a.IP != nil {
+		rv.IP, rv.Port = a.IP, a.Port
+		return rv
+	}
+	if a, err := net.ResolveTCPAddr("tcp", addr.String()); err == nil && a.IP != nil {
+		rv.IP, rv.Port = a.IP, a.Port
+	}
+	return rv
+}
+
+func inetSum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+func inetChecksum(sum uint32, b []byte) uint16 {
+	sum = inetSum(sum, b)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
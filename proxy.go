@@ -2,8 +2,10 @@ package httpproxy
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"net/http"
 	"sync/atomic"
+	"time"
 )
 
 // Proxy defines parameters for running an HTTP Proxy. It implements
@@ -35,6 +37,20 @@ type Proxy struct {
 	// If it returns true, authentication succeeded.
 	OnAuth func(ctx *Context, authType string, user string, pass string) bool
 
+	// Digest auth callback. If "Digest" scheme is offered, set this callback
+	// instead of OnAuth. It returns hex encoded HA1 of user in realm for
+	// algorithm ("MD5" or "SHA-256"), see DigestHA1.
+	// If ok is false, user doesn't exist.
+	OnDigestAuth func(ctx *Context, user string, realm string, algorithm string) (ha1 string, ok bool)
+
+	// Client certificate auth callback. It maps verified certificate
+	// presented by client on TLS proxy listener to user. Set ClientAuth and
+	// ClientCAs of listener's TLS config to request certificates.
+	// If ok is true, authentication succeeded without challenge. If it's set
+	// and no other scheme is offered, clients without a valid certificate
+	// are rejected by 403 response.
+	OnCertAuth func(ctx *Context, cert *x509.Certificate) (user string, ok bool)
+
 	// Connect callback. It sets connect action and new host.
 	// If len(newhost) > 0, host changes.
 	OnConnect func(ctx *Context, host string) (ConnectAction ConnectAction,
@@ -48,15 +64,189 @@ type Proxy struct {
 	// Remote response sends after this callback.
 	OnResponse func(ctx *Context, req *http.Request, resp *http.Response)
 
+	// Tunnel open callback. It greets tunnel of ConnectProxy after remote
+	// connected, or MITM session after TLS handshake.
+	OnTunnelOpen func(ctx *Context)
+
+	// Tunnel close callback. It greets statistics of tunnel opened by
+	// OnTunnelOpen, when it closed.
+	OnTunnelClose func(ctx *Context, stats *TunnelStats)
+
+	// Tunnel data callback. It greets each chunk of data passing through
+	// ConnectProxy tunnel in the direction. Returned data is sent instead of
+	// the chunk, it may be empty to drop the chunk. The chunk is reused
+	// after the callback returns.
+	// If it returns non-nil error, tunnel closes.
+	OnTunnelData func(ctx *Context, dir Direction, data []byte) (newData []byte, err error)
+
+	// Mail line callback. It greets each decrypted line of ConnectMitmSMTP,
+	// ConnectMitmIMAP and ConnectMitmPOP3 after STARTTLS, including line
+	// ending. Returned line is sent instead of the line.
+	// If it returns non-nil error, connection closes.
+	OnMailLine func(ctx *Context, dir Direction, line []byte) (newLine []byte, err error)
+
+	// MITM TLS config callback. It greets TLS server config of ConnectMitm
+	// before handshake, to change it for the context.
+	OnMitmTLSConfig func(ctx *Context, config *tls.Config)
+
+	// MITM client certificate callback. It greets certificates presented by
+	// client on ConnectMitm, if MitmClientAuth requests them.
+	// If it returns non-nil certificate, it's presented to remote instead of
+	// client certificate.
+	OnMitmClientCert func(ctx *Context, certs []*x509.Certificate) (remoteCert *tls.Certificate)
+
 	// If ConnectAction is ConnectMitm, it sets chunked to Transfer-Encoding.
 	// By default, true.
 	MitmChunked bool
 
 	// HTTP Authentication type. If it's not specified (""), uses "Basic".
+	// "Basic", "Digest" and "Bearer" are supported.
 	// By default, "".
 	AuthType string
 
-	signer *CaSigner
+	// Verifier of JWTs. If "Bearer" scheme is offered, set this verifier
+	// instead of OnAuth. Claims of verified token are set to ctx.Claims.
+	// By default, nil.
+	JWTVerifier *JWTVerifier
+
+	// Authentication schemes offered to clients, in order of preference,
+	// e.g. []string{"Negotiate", "Digest", "Basic"}. A challenge is sent for
+	// each scheme, and credentials are verified by the scheme client chose.
+	// If it's set, AuthType is ignored. If a scheme has no handler, requests
+	// are rejected by 500 response and ErrAuthScheme.
+	// By default, nil.
+	AuthTypes []string
+
+	// Connection-oriented authenticator, e.g. NTLMAuthenticator. A client
+	// connection is authenticated by a handshake over several requests. If
+	// AuthTypes isn't set, it's the only offered scheme, and AuthType is
+	// ignored. It requires http.Server.ConnState to be set to
+	// Proxy.ConnState, see it.
+	// By default, nil.
+	ConnAuth ConnAuthenticator
+
+	// Access control list evaluated after OnConnect and before OnRequest.
+	// It may deny CONNECT and requests, or change ConnectAction.
+	// By default, nil.
+	ACL *ACL
+
+	// Guard against repeated authentication failures, with cache of
+	// successful authentications.
+	// By default, nil.
+	AuthGuard *AuthGuard
+
+	// Realm of authentication challenges.
+	// By default, "httpproxy".
+	AuthRealm string
+
+	// Lifetime of nonces issued for Digest authentication. Clients are asked
+	// to retry with a new nonce after it.
+	// By default, 5 minutes.
+	DigestNonceLifetime time.Duration
+
+	// Pcapng writer to export proxied traffic. If it's not nil, tunnel bytes
+	// of ConnectProxy and client side bytes of ConnectMitm, including
+	// STARTTLS sessions, are written as synthesized TCP streams. MITM TLS
+	// records are written as sent, and their keys are written as decryption
+	// secrets, so Wireshark decrypts them.
+	// By default, nil.
+	Pcap *PcapngWriter
+
+	// If it's true, proxy responds CONNECT request and peeks TLS ClientHello
+	// before OnConnect callback, so OnConnect can use ctx.ClientHello, ctx.JA3
+	// and ctx.JA4. ACL is checked before responding, but remote host is
+	// dialed only after OnConnect, so its errors close client connection
+	// without a response. Peeking waits for 1 second at most, so
+	// server-first protocols like SMTP are delayed that long. If OnConnect or
+	// ACL denies tunnel after that, client connection is closed.
+	// By default, false.
+	PeekClientHello bool
+
+	// Client certificates to present to remote TLS servers. If it's not nil,
+	// a certificate is looked up by remote host and authenticated user for
+	// HTTPS requests, including ConnectMitm sessions. It requires Rt to be
+	// *http.Transport or *MirrorTransport.
+	// By default, nil.
+	ClientCerts *ClientCertStore
+
+	// If ConnectAction is ConnectMitm, TLS server config is cloned from this
+	// template for each session, e.g. to set versions, cipher suites, curves
+	// or session tickets. Certificates and GetCertificate are replaced by
+	// forged certificate. Session ticket keys are shared by all sessions and
+	// rotated by proxy, so clients can resume sessions.
+	// By default, nil.
+	MitmTLSConfig *tls.Config
+
+	// If ConnectAction is ConnectMitm, it sets client authentication policy
+	// of TLS server. Presented certificates are set to ctx.MitmClientCerts.
+	// If it's tls.NoClientCert, MitmTLSConfig's policy is used.
+	// By default, tls.NoClientCert.
+	MitmClientAuth tls.ClientAuthType
+
+	// If it's not "", identity of certificate presented by client on
+	// ConnectMitm is forwarded to remote in this header, e.g.
+	// "X-Forwarded-Client-Cert". Only certificates verified by
+	// MitmTLSConfig.ClientCAs are forwarded, so MitmClientAuth must be
+	// tls.VerifyClientCertIfGiven or tls.RequireAndVerifyClientCert. The
+	// header sent by client is always removed.
+	// By default, "".
+	MitmClientCertHeader string
+
+	// If it's not "", authenticated identity of client is forwarded to remote
+	// in this header signed by IdentityHeaderKey, e.g. "X-Proxy-Identity",
+	// see VerifyIdentityHeader. The header sent by client is always removed.
+	// By default, "".
+	IdentityHeader string
+
+	// HMAC-SHA256 key signing IdentityHeader, shared with remote services.
+	// IdentityHeader isn't forwarded without it.
+	// By default, nil.
+	IdentityHeaderKey []byte
+
+	// Timeout of connecting to remote host of CONNECT request. It doesn't
+	// apply to Rt, which has its own dialer. If it fires, ErrDialTimeout is
+	// reported.
+	// By default, 0 (no timeout).
+	DialTimeout time.Duration
+
+	// Tunnel or MITM session is closed if there is no traffic in both
+	// directions for this duration. If it fires, ErrIdleTimeout is reported.
+	// By default, 0 (no timeout).
+	IdleTimeout time.Duration
+
+	// If ConnectAction is ConnectMitm, timeout of TLS handshake and of
+	// reading each request header, including waiting for it. If it fires,
+	// ErrHeaderTimeout is reported.
+	// By default, 0 (no timeout).
+	MitmHeaderTimeout time.Duration
+
+	// Maximum lifetime of tunnel or MITM session after CONNECT request is
+	// accepted. If it's exceeded, ErrLifetimeExceeded is reported.
+	// By default, 0 (no limit).
+	MaxTunnelLifetime time.Duration
+
+	// Per-client limits of tunnels, MITM requests, request rate and
+	// connection rate. Rejected requests are reported as ErrLimitExceeded.
+	// By default, nil (no limits).
+	Limits *Limits
+
+	// Bandwidth limits of tunnels and HTTP bodies, globally, per user and
+	// per remote host.
+	// By default, nil (no limits).
+	Shaper *Shaper
+
+	// Usage quotas of users, see Quotas.Key. Requests of users exhausted
+	// quota are rejected by 403 response, and tunnels and bodies closed for
+	// quota are reported as ErrQuotaExceeded.
+	// By default, nil (no quotas).
+	Quotas *Quotas
+
+	signer         *CaSigner
+	certTransports transportCache
+	ticketKeys     sessionTicketKeys
+	hijacked       hijackedConns
+	digestNonces   digestNonces
+	connAuthStates connAuthStates
 }
 
 // NewProxy returns a new Proxy has default CA certificate and key.
@@ -90,6 +280,9 @@ func NewProxyCert(caCert, caKey []byte) (*Proxy, error) {
 // ServeHTTP implements http.Handler.
 func (prx *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := &Context{Prx: prx, SessionNo: atomic.AddInt64(&prx.SessionNo, 1)}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		ctx.ProxyClientCert = r.TLS.PeerCertificates[0]
+	}
 
 	defer func() {
 		rec := recover()
@@ -100,10 +293,14 @@ func (prx *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			panic(rec)
 		}
 	}()
+	defer prx.hijacked.remove(ctx)
 
 	if ctx.doAccept(w, r) {
 		return
 	}
+	if ctx.doConnLimits(w, r) {
+		return
+	}
 
 	if ctx.doAuth(w, r) {
 		return
@@ -112,11 +309,21 @@ func (prx *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.Header.Del("Proxy-Authenticate")
 	r.Header.Del("Proxy-Authorization")
 
+	if ctx.doLimits(w, r) {
+		return
+	}
+	defer ctx.releaseLimits()
+	if b, _ := ctx.doQuota(w, r); b {
+		return
+	}
+	defer ctx.releaseShaping()
+
 	if b := ctx.doConnect(w, r); b {
 		return
 	}
 
 	for {
+		ctx.releaseMitmLimits()
 		var w2 = w
 		var r2 = r
 		var cyclic = false
@@ -125,7 +332,16 @@ func (prx *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			if prx.MitmChunked {
 				cyclic = true
 			}
-			w2, r2 = ctx.doMitm()
+			w2, r2 = nil, nil
+			if prx.hijacked.setIdle(ctx, true) {
+				// A request read as shutdown starts is still served, and
+				// session closes after its response.
+				w2, r2 = ctx.doMitm()
+				prx.hijacked.setIdle(ctx, false)
+				if w2 != nil {
+					w2 = &drainResponseWriter{ResponseWriter: w2, h: &prx.hijacked}
+				}
+			}
 		}
 		if w2 == nil || r2 == nil {
 			break
@@ -133,7 +349,22 @@ func (prx *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		//r.Header.Del("Accept-Encoding")
 		//r.Header.Del("Connection")
 		ctx.SubSessionNo++
+		if ctx.ConnectAction == ConnectMitm {
+			if b, err := ctx.doMitmLimits(w2, r2); b {
+				if err != nil || !cyclic {
+					break
+				}
+				continue
+			}
+			if b, err := ctx.doQuota(w2, r2); b {
+				if err != nil || !cyclic {
+					break
+				}
+				continue
+			}
+		}
 		if b, err := ctx.doRequest(w2, r2); err != nil {
+			ctx.tunnelClosed(SideClient, err)
 			break
 		} else {
 			if b {
@@ -145,11 +376,19 @@ func (prx *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if err := ctx.doResponse(w2, r2); err != nil || !cyclic {
+			if err != nil {
+				ctx.tunnelClosed(SideClient, err)
+			}
 			break
 		}
 	}
+	ctx.releaseMitmLimits()
 
 	if ctx.hijTLSConn != nil {
 		ctx.hijTLSConn.Close()
 	}
+	if ctx.pcapStream != nil {
+		ctx.pcapStream.Close()
+	}
+	ctx.closeTunnel()
 }
@@ -0,0 +1,421 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Usage keeps usage counters of a user.
+type Usage struct {
+	// Bytes sent in both directions, including request and response bodies
+	// and tunnel data.
+	Bytes int64
+
+	// Count of proxy requests, MITM requests and tunnels.
+	Requests int64
+
+	// Start time of counting, after the last reset.
+	Since time.Time
+}
+
+// QuotaLimit defines quota of a user. A zero limit means no limit.
+type QuotaLimit struct {
+	// Maximum bytes.
+	Bytes int64
+
+	// Maximum count of requests.
+	Requests int64
+}
+
+// QuotaStore persists usage counters of users.
+type QuotaStore interface {
+	// Load returns saved usage of users.
+	Load() (map[string]Usage, error)
+
+	// Save saves usage of all users.
+	Save(usage map[string]Usage) error
+}
+
+// FileQuotaStore is a QuotaStore saves usage to a JSON file.
+type FileQuotaStore struct {
+	// Path of the file.
+	Path string
+}
+
+// NewFileQuotaStore returns a new FileQuotaStore given file path.
+func NewFileQuotaStore(path string) *FileQuotaStore {
+	return &FileQuotaStore{Path: path}
+}
+
+// Load implements QuotaStore. If the file doesn't exist, it returns empty
+// usage.
+func (s *FileQuotaStore) Load() (map[string]Usage, error) {
+	usage := make(map[string]Usage)
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// Save implements QuotaStore. The file is replaced atomically.
+func (s *FileQuotaStore) Save(usage map[string]Usage) error {
+	data, err := json.MarshalIndent(usage, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.Path)
+}
+
+// Quotas tracks usage of users over plain requests, MITM requests and
+// tunnels, and limits it by quotas. Requests of users exhausted quota are
+// rejected by 403 response, and their open tunnels are closed or throttled.
+// Both are reported as ErrQuotaExceeded. It's safe for concurrent use.
+type Quotas struct {
+	// Store of usage counters.
+	Store QuotaStore
+
+	// Interval of saving usage counters to Store while they change.
+	// By default, 1 minute.
+	SaveInterval time.Duration
+
+	// If it's not zero, traffic of open tunnels and bodies of users exhausted
+	// quota is throttled to this rate instead of closed.
+	ThrottleRate Rate
+
+	// Key function identifies user of context to count usage. If it returns
+	// "", usage isn't counted and quota isn't applied. Set it to LimitKeyUser
+	// to count unauthenticated clients by IP address, then limits of users
+	// are set by keys like "user:alice".
+	// By default, authenticated user, so unauthenticated clients aren't
+	// counted.
+	Key func(ctx *Context) string
+
+	mu       sync.Mutex
+	limits   map[string]QuotaLimit
+	usage    map[string]*Usage
+	throttle map[string]*tokenBucket
+	dirty    bool
+	saving   bool
+	lastSave time.Time
+}
+
+// NewQuotas returns a new Quotas given store, and loads usage counters from
+// it. If store is nil, usage isn't persisted.
+func NewQuotas(store QuotaStore) (*Quotas, error) {
+	q := &Quotas{
+		Store:    store,
+		limits:   make(map[string]QuotaLimit),
+		usage:    make(map[string]*Usage),
+		throttle: make(map[string]*tokenBucket),
+		lastSave: time.Now(),
+	}
+	if store != nil {
+		usage, err := store.Load()
+		if err != nil {
+			return nil, err
+		}
+		for user, u := range usage {
+			u := u
+			q.usage[user] = &u
+		}
+	}
+	return q, nil
+}
+
+// SetLimit sets quota given user. If user is "", limit applies to each user
+// without own limit.
+func (q *Quotas) SetLimit(user string, limit QuotaLimit) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limits[user] = limit
+}
+
+// Usage returns usage of user.
+func (q *Quotas) Usage(user string) Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if u := q.usage[user]; u != nil {
+		return *u
+	}
+	return Usage{}
+}
+
+// AllUsage returns usage of all users.
+func (q *Quotas) AllUsage() map[string]Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.snapshot()
+}
+
+// Reset resets usage of user, e.g. at start of a new billing period.
+func (q *Quotas) Reset(user string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.usage[user] = &Usage{Since: time.Now()}
+	delete(q.throttle, user)
+	q.dirty = true
+}
+
+// ResetAll resets usage of all users.
+func (q *Quotas) ResetAll() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for _, u := range q.usage {
+		*u = Usage{Since: now}
+	}
+	q.throttle = make(map[string]*tokenBucket)
+	q.dirty = true
+}
+
+// Exhausted checks user exhausted quota.
+func (q *Quotas) Exhausted(user string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.exhausted(user)
+}
+
+// Save saves usage counters to Store. Call it before exit to save the latest
+// counters. If it fails, counters are saved again after SaveInterval.
+func (q *Quotas) Save() error {
+	if q.Store == nil {
+		return nil
+	}
+	q.mu.Lock()
+	usage := q.snapshot()
+	q.dirty = false
+	q.lastSave = time.Now()
+	q.mu.Unlock()
+	err := q.Store.Save(usage)
+	if err != nil {
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+	}
+	return err
+}
+
+// snapshot returns copy of usage. q.mu must be locked.
+func (q *Quotas) snapshot() map[string]Usage {
+	usage := make(map[string]Usage, len(q.usage))
+	for user, u := range q.usage {
+		usage[user] = *u
+	}
+	return usage
+}
+
+func (q *Quotas) limit(user string) QuotaLimit {
+	if l, ok := q.limits[user]; ok {
+		return l
+	}
+	return q.limits[""]
+}
+
+// exhausted checks user exhausted quota. q.mu must be locked.
+func (q *Quotas) exhausted(user string) bool {
+	u := q.usage[user]
+	if u == nil {
+		return false
+	}
+	l := q.limit(user)
+	return (l.Bytes > 0 && u.Bytes >= l.Bytes) || (l.Requests > 0 && u.Requests >= l.Requests)
+}
+
+// add adds usage of user, and returns whether user exhausted quota.
+func (q *Quotas) add(user string, bytes int64, requests int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usage[user]
+	if u == nil {
+		u = &Usage{Since: time.Now()}
+		q.usage[user] = u
+	}
+	u.Bytes += bytes
+	u.Requests += requests
+	q.dirty = true
+	return q.exhausted(user)
+}
+
+// saveDue checks usage should be saved now, and marks saving.
+func (q *Quotas) saveDue() bool {
+	interval := q.SaveInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.Store == nil || !q.dirty || q.saving || time.Since(q.lastSave) < interval {
+		return false
+	}
+	q.saving = true
+	return true
+}
+
+// throttleWait returns duration to wait before sending n bytes of user
+// exhausted quota.
+func (q *Quotas) throttleWait(user string, n int) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	b := q.throttle[user]
+	if b == nil {
+		b = &tokenBucket{}
+		q.throttle[user] = b
+	}
+	r := q.ThrottleRate
+	return b.reserve(time.Now(), r.BytesPerSecond, r.burst(), float64(n))
+}
+
+// quotaError describes which user exhausted quota. It's passed as opErr with
+// ErrQuotaExceeded.
+type quotaError struct {
+	user string
+}
+
+func (e *quotaError) Error() string {
+	return "quota of user " + e.user + " exhausted"
+}
+
+// key returns user of context to count usage, or "" if it isn't counted.
+func (q *Quotas) key(ctx *Context) string {
+	if q.Key != nil {
+		return q.Key(ctx)
+	}
+	return ctx.AuthUser
+}
+
+// account adds usage of context, and saves usage if it's due. If quota is
+// exhausted, it returns an error, or waits if quota is throttled.
+func (ctx *Context) account(bytes int64, requests int64) error {
+	q := ctx.Prx.Quotas
+	user := q.key(ctx)
+	exhausted := q.add(user, bytes, requests)
+	if q.saveDue() {
+		go func() {
+			if err := q.Save(); err != nil {
+				ctx.doError("Quota", ErrQuotaSave, err)
+			}
+			q.mu.Lock()
+			q.saving = false
+			q.mu.Unlock()
+		}()
+	}
+	if !exhausted || requests > 0 {
+		return nil
+	}
+	if q.ThrottleRate.BytesPerSecond > 0 {
+		if d := q.throttleWait(user, int(bytes)); d > 0 {
+			time.Sleep(d)
+		}
+		return nil
+	}
+	return &quotaError{user}
+}
+
+// doQuota checks quota of user and counts a new request. If quota is
+// exhausted, it responds 403 and returns true with error of response.
+func (ctx *Context) doQuota(w http.ResponseWriter, r *http.Request) (bool, error) {
+	q := ctx.Prx.Quotas
+	if q == nil {
+		return false, nil
+	}
+	user := q.key(ctx)
+	if user == "" {
+		return false, nil
+	}
+	if q.Exhausted(user) {
+		if r.Body != nil {
+			defer r.Body.Close()
+		}
+		ctx.doError("Quota", ErrQuotaExceeded, &quotaError{user})
+		u := q.Usage(user)
+		body := fmt.Sprintf("<html><head><title>Quota exceeded</title></head><body>"+
+			"<h1>Quota exceeded</h1><p>User %s has used %d bytes in %d requests since %s.</p>"+
+			"</body></html>", html.EscapeString(user), u.Bytes, u.Requests,
+			u.Since.Format(time.RFC1123))
+		err := ServeInMemory(w, http.StatusForbidden,
+			map[string][]string{"Content-Type": {"text/html; charset=utf-8"}}, []byte(body))
+		ctx.doTunnelError("Quota", ErrResponseWrite, err)
+		return true, err
+	}
+	ctx.account(0, 1)
+	return false, nil
+}
+
+// quotaConn is a net.Conn counts written bytes to quota of user.
+type quotaConn struct {
+	net.Conn
+	ctx *Context
+}
+
+func (c *quotaConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		if qerr := c.ctx.account(int64(n), 0); qerr != nil && err == nil {
+			err = &tunnelAbortError{qerr}
+		}
+	}
+	return n, err
+}
+
+// quotaReadCloser is an io.ReadCloser counts read bytes to quota of user.
+type quotaReadCloser struct {
+	io.ReadCloser
+	ctx *Context
+}
+
+func (r *quotaReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		if qerr := r.ctx.account(int64(n), 0); qerr != nil && (err == nil || err == io.EOF) {
+			err = qerr
+		}
+	}
+	return n, err
+}
+
+// quotaConn returns tunnel conn counts written bytes to quota, if
+// Proxy.Quotas is set and usage of context is counted.
+func (ctx *Context) quotaConn(conn net.Conn) net.Conn {
+	if ctx.Prx.Quotas == nil || ctx.Prx.Quotas.key(ctx) == "" {
+		return conn
+	}
+	return &quotaConn{Conn: conn, ctx: ctx}
+}
+
+// quotaBody returns body counts read bytes to quota, if Proxy.Quotas is set
+// and usage of context is counted.
+func (ctx *Context) quotaBody(body io.ReadCloser) io.ReadCloser {
+	if ctx.Prx.Quotas == nil || ctx.Prx.Quotas.key(ctx) == "" || body == nil || body == http.NoBody {
+		return body
+	}
+	return &quotaReadCloser{ReadCloser: body, ctx: ctx}
+}
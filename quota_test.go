@@ -0,0 +1,176 @@
+package httpproxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileQuotaStore(t *testing.T) {
+	s := NewFileQuotaStore(filepath.Join(t.TempDir(), "usage.json"))
+	usage, err := s.Load()
+	if err != nil || len(usage) != 0 {
+		t.Fatalf("missing file: %v, %v", usage, err)
+	}
+	since := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := map[string]Usage{"alice": {Bytes: 100, Requests: 2, Since: since}}
+	if err := s.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	usage, err = s.Load()
+	if err != nil || len(usage) != 1 || usage["alice"] != want["alice"] {
+		t.Errorf("loaded %v, %v, want %v", usage, err, want)
+	}
+}
+
+func TestQuotasLimit(t *testing.T) {
+	q, err := NewQuotas(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.SetLimit("", QuotaLimit{Requests: 2})
+	q.SetLimit("alice", QuotaLimit{Bytes: 100})
+	if q.add("alice", 99, 5) {
+		t.Error("alice exhausted under own limit")
+	}
+	if !q.add("alice", 1, 0) || !q.Exhausted("alice") {
+		t.Error("alice isn't exhausted at own limit")
+	}
+	if q.add("bob", 1000, 1) || !q.add("bob", 0, 1) {
+		t.Error("bob isn't limited by default limit")
+	}
+	if u := q.Usage("bob"); u.Bytes != 1000 || u.Requests != 2 || u.Since.IsZero() {
+		t.Errorf("usage of bob %+v", u)
+	}
+	q.Reset("alice")
+	if q.Exhausted("alice") || !q.Exhausted("bob") {
+		t.Error("Reset resets usage of other users")
+	}
+	q.ResetAll()
+	if q.Exhausted("bob") || len(q.AllUsage()) != 2 {
+		t.Errorf("after ResetAll: %v", q.AllUsage())
+	}
+}
+
+// testQuotaStore is a QuotaStore keeps usage in memory, and fails if err is
+// set.
+type testQuotaStore struct {
+	usage map[string]Usage
+	err   error
+}
+
+func (s *testQuotaStore) Load() (map[string]Usage, error) {
+	return s.usage, nil
+}
+
+func (s *testQuotaStore) Save(usage map[string]Usage) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.usage = usage
+	return nil
+}
+
+func TestQuotasSave(t *testing.T) {
+	s := &testQuotaStore{usage: map[string]Usage{"alice": {Bytes: 10}}}
+	q, err := NewQuotas(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.SaveInterval = time.Hour
+	if u := q.Usage("alice"); u.Bytes != 10 {
+		t.Fatalf("loaded usage %+v", u)
+	}
+	q.add("alice", 5, 1)
+
+	// Failed save keeps counters dirty.
+	s.err = errors.New("disk full")
+	if err := q.Save(); err != s.err {
+		t.Fatalf("save: %v, want %v", err, s.err)
+	}
+	if !q.dirty {
+		t.Error("counters aren't dirty after failed save")
+	}
+	q.lastSave = time.Now().Add(-2 * time.Hour)
+	if !q.saveDue() {
+		t.Error("save isn't due after failed save")
+	}
+	q.saving = false
+
+	s.err = nil
+	if err := q.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if q.dirty || s.usage["alice"].Bytes != 15 {
+		t.Errorf("after save: dirty %v, saved %+v", q.dirty, s.usage)
+	}
+	if q.saveDue() {
+		t.Error("save is due without changes")
+	}
+}
+
+func TestQuotasProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100))
+	}))
+	defer origin.Close()
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prx.Rt = &http.Transport{}
+	prx.OnAuth = func(ctx *Context, authType string, user string, pass string) bool {
+		return pass == "secret"
+	}
+	prx.OnRequest = func(ctx *Context, req *http.Request) *http.Response {
+		if req.URL.Path == "/local" {
+			return InMemoryResponse(200, nil, make([]byte, 50))
+		}
+		return nil
+	}
+	if prx.Quotas, err = NewQuotas(nil); err != nil {
+		t.Fatal(err)
+	}
+	prx.Quotas.SetLimit("", QuotaLimit{Requests: 2})
+	srv := httptest.NewServer(prx)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	get := func(user string, path string) int {
+		req, _ := http.NewRequest("GET", origin.URL+path, nil)
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":secret")))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Bodies of both upstream and OnRequest responses are counted.
+	if code := get("alice", "/"); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if code := get("alice", "/local"); code != http.StatusOK {
+		t.Fatalf("OnRequest response: status %d", code)
+	}
+	if u := prx.Quotas.Usage("alice"); u.Bytes != 150 || u.Requests != 2 {
+		t.Errorf("usage %+v, want 150 bytes in 2 requests", u)
+	}
+	if code := get("alice", "/"); code != http.StatusForbidden {
+		t.Errorf("exhausted quota: status %d", code)
+	}
+	if code := get("bob", "/"); code != http.StatusOK {
+		t.Errorf("other user: status %d", code)
+	}
+	if u := prx.Quotas.Usage("bob"); u.Requests != 1 {
+		t.Errorf("usage of other user %+v", u)
+	}
+}
@@ -0,0 +1,340 @@
+package httpproxy
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate defines a bandwidth limit.
+type Rate struct {
+	// Bytes per second. If it's 0, bandwidth isn't limited.
+	BytesPerSecond float64
+
+	// Maximum bytes sent at once over the rate.
+	// By default, BytesPerSecond rounded up.
+	Burst int
+}
+
+func (r Rate) burst() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return math.Max(1, math.Ceil(r.BytesPerSecond))
+}
+
+// ShapeRule defines bandwidth limits of both directions.
+type ShapeRule struct {
+	// Limit of data sent from client to remote.
+	Upload Rate
+
+	// Limit of data sent from remote to client.
+	Download Rate
+}
+
+func (r ShapeRule) rate(dir Direction) Rate {
+	if dir == DirectionUpstream {
+		return r.Upload
+	}
+	return r.Download
+}
+
+// Shaper limits bandwidth of tunnels and HTTP bodies by token buckets,
+// globally, per authenticated user and per remote host. Traffic is limited by
+// all rules match it. Rules can be changed while running, and changes apply
+// to open tunnels. It's safe for concurrent use.
+type Shaper struct {
+	mu      sync.Mutex
+	global  ShapeRule
+	users   map[string]ShapeRule
+	hosts   []shapeHostRule
+	buckets map[shapeKey]*shapeBucket
+	gen     int64
+
+	nextSweep time.Time
+}
+
+type shapeHostRule struct {
+	pattern string
+	rule    ShapeRule
+}
+
+// Scopes of shapeKey.
+const (
+	shapeGlobal = iota
+	shapeUser
+	shapeHost
+)
+
+type shapeKey struct {
+	scope int
+	name  string
+	dir   Direction
+}
+
+// shapeBucket is a token bucket shared by transfers of a shapeKey.
+type shapeBucket struct {
+	key    shapeKey
+	refs   int
+	gen    int64
+	rate   Rate
+	tokens tokenBucket
+}
+
+// NewShaper returns a new Shaper without rules.
+func NewShaper() *Shaper {
+	return &Shaper{
+		users:   make(map[string]ShapeRule),
+		buckets: make(map[shapeKey]*shapeBucket),
+	}
+}
+
+// SetGlobal sets rule shared by all traffic.
+func (s *Shaper) SetGlobal(rule ShapeRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.global = rule
+	s.gen++
+}
+
+// SetUser sets rule given authenticated user. Each user has own bandwidth.
+// If user is "", rule applies to each authenticated user without own rule.
+// Zero rule removes rule.
+func (s *Shaper) SetUser(user string, rule ShapeRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rule == (ShapeRule{}) {
+		delete(s.users, user)
+	} else {
+		s.users[user] = rule
+	}
+	s.gen++
+}
+
+// SetHost sets rule given remote host pattern. Host patterns are matched with
+// path.Match against host name without port, and first added match wins.
+// Each matched host has own bandwidth. Zero rule removes rule.
+func (s *Shaper) SetHost(pattern string, rule ShapeRule) error {
+	pattern = strings.ToLower(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.hosts {
+		if r.pattern == pattern {
+			if rule == (ShapeRule{}) {
+				s.hosts = append(s.hosts[:i], s.hosts[i+1:]...)
+			} else {
+				s.hosts[i].rule = rule
+			}
+			s.gen++
+			return nil
+		}
+	}
+	if rule != (ShapeRule{}) {
+		s.hosts = append(s.hosts, shapeHostRule{pattern: pattern, rule: rule})
+		s.gen++
+	}
+	return nil
+}
+
+// rate returns current rate of key. s.mu must be locked.
+func (s *Shaper) rate(key shapeKey) Rate {
+	switch key.scope {
+	case shapeGlobal:
+		return s.global.rate(key.dir)
+	case shapeUser:
+		if r, ok := s.users[key.name]; ok {
+			return r.rate(key.dir)
+		}
+		return s.users[""].rate(key.dir)
+	case shapeHost:
+		for _, r := range s.hosts {
+			if ok, _ := path.Match(r.pattern, key.name); ok {
+				return r.rule.rate(key.dir)
+			}
+		}
+	}
+	return Rate{}
+}
+
+// acquire returns buckets of traffic given direction, user and host.
+func (s *Shaper) acquire(dir Direction, user string, host string) []*shapeBucket {
+	keys := []shapeKey{{scope: shapeGlobal, dir: dir}}
+	if user != "" {
+		keys = append(keys, shapeKey{scope: shapeUser, name: user, dir: dir})
+	}
+	if host = strings.ToLower(stripPort(host)); host != "" {
+		keys = append(keys, shapeKey{scope: shapeHost, name: host, dir: dir})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(time.Now())
+	var buckets []*shapeBucket
+	for _, key := range keys {
+		b := s.buckets[key]
+		if b == nil {
+			b = &shapeBucket{key: key, gen: -1}
+			s.buckets[key] = b
+		}
+		b.refs++
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// release releases buckets returned by acquire. A bucket without transfers
+// is kept until it's full again, so new transfers don't get a fresh burst.
+func (s *Shaper) release(buckets []*shapeBucket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, b := range buckets {
+		if b.refs--; b.refs == 0 && s.idle(b, now) {
+			delete(s.buckets, b.key)
+		}
+	}
+}
+
+// idle checks bucket has no transfers and is full at now. s.mu must be
+// locked.
+func (s *Shaper) idle(b *shapeBucket, now time.Time) bool {
+	if b.refs > 0 {
+		return false
+	}
+	if b.gen != s.gen {
+		b.rate, b.gen = s.rate(b.key), s.gen
+	}
+	return b.rate.BytesPerSecond <= 0 || b.tokens.full(now, b.rate.BytesPerSecond, b.rate.burst())
+}
+
+// sweep removes idle buckets. s.mu must be locked.
+func (s *Shaper) sweep(now time.Time) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	for key, b := range s.buckets {
+		if s.idle(b, now) {
+			delete(s.buckets, key)
+		}
+	}
+	s.nextSweep = now.Add(time.Minute)
+}
+
+// chunk returns maximum size to transfer at once by buckets.
+func (s *Shaper) chunk(buckets []*shapeBucket, n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range buckets {
+		if b.gen != s.gen {
+			b.rate, b.gen = s.rate(b.key), s.gen
+		}
+		if b.rate.BytesPerSecond > 0 && float64(n) > b.rate.burst() {
+			n = int(b.rate.burst())
+		}
+	}
+	return n
+}
+
+// wait takes n bytes from buckets and sleeps until they're available.
+func (s *Shaper) wait(buckets []*shapeBucket, n int) {
+	s.mu.Lock()
+	now := time.Now()
+	var d time.Duration
+	for _, b := range buckets {
+		if b.gen != s.gen {
+			b.rate, b.gen = s.rate(b.key), s.gen
+		}
+		if b.rate.BytesPerSecond <= 0 {
+			continue
+		}
+		if w := b.tokens.reserve(now, b.rate.BytesPerSecond, b.rate.burst(), float64(n)); w > d {
+			d = w
+		}
+	}
+	s.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// shapedConn is a net.Conn limits bandwidth of writes.
+type shapedConn struct {
+	net.Conn
+	s       *Shaper
+	buckets []*shapeBucket
+}
+
+func (c *shapedConn) Write(b []byte) (written int, err error) {
+	for len(b) > 0 {
+		n := c.s.chunk(c.buckets, len(b))
+		c.s.wait(c.buckets, n)
+		n, err = c.Conn.Write(b[:n])
+		written += n
+		if err != nil {
+			return
+		}
+		b = b[n:]
+	}
+	return
+}
+
+// shapedReadCloser is an io.ReadCloser limits bandwidth of reads. Buckets are
+// released when it's closed.
+type shapedReadCloser struct {
+	io.ReadCloser
+	s       *Shaper
+	buckets []*shapeBucket
+	once    sync.Once
+}
+
+func (r *shapedReadCloser) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return r.ReadCloser.Read(b)
+	}
+	n, err := r.ReadCloser.Read(b[:r.s.chunk(r.buckets, len(b))])
+	if n > 0 {
+		r.s.wait(r.buckets, n)
+	}
+	return n, err
+}
+
+func (r *shapedReadCloser) Close() error {
+	r.once.Do(func() { r.s.release(r.buckets) })
+	return r.ReadCloser.Close()
+}
+
+// shapeConn returns tunnel conn limits bandwidth of writes in the direction,
+// if Proxy.Shaper is set. Buckets are released at end of context.
+func (ctx *Context) shapeConn(conn net.Conn, dir Direction) net.Conn {
+	s := ctx.Prx.Shaper
+	if s == nil {
+		return conn
+	}
+	buckets := s.acquire(dir, ctx.AuthUser, ctx.ConnectHost)
+	ctx.shaped = append(ctx.shaped, buckets...)
+	return &shapedConn{Conn: conn, s: s, buckets: buckets}
+}
+
+// shapeBody returns body limits bandwidth of reads in the direction to host,
+// if Proxy.Shaper is set.
+func (ctx *Context) shapeBody(body io.ReadCloser, dir Direction, host string) io.ReadCloser {
+	if ctx.Prx.Shaper == nil || body == nil || body == http.NoBody {
+		return body
+	}
+	s := ctx.Prx.Shaper
+	return &shapedReadCloser{ReadCloser: body, s: s, buckets: s.acquire(dir, ctx.AuthUser, host)}
+}
+
+func (ctx *Context) releaseShaping() {
+	if len(ctx.shaped) > 0 {
+		ctx.Prx.Shaper.release(ctx.shaped)
+		ctx.shaped = nil
+	}
+}
@@ -0,0 +1,182 @@
+package httpproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testShapedConn returns a shapedConn of user to host, which writes to a
+// connection drained by a goroutine, and count of drained bytes.
+func testShapedConn(t *testing.T, s *Shaper, user string, host string) (net.Conn, *int64) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	var n int64
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			m, err := server.Read(b)
+			atomic.AddInt64(&n, int64(m))
+			if err != nil {
+				return
+			}
+		}
+	}()
+	buckets := s.acquire(DirectionDownstream, user, host)
+	t.Cleanup(func() { s.release(buckets) })
+	return &shapedConn{Conn: client, s: s, buckets: buckets}, &n
+}
+
+func TestShaperRate(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(s *Shaper)
+	}{
+		{"global", func(s *Shaper) {
+			s.SetGlobal(ShapeRule{Download: Rate{BytesPerSecond: 100000, Burst: 10000}})
+		}},
+		{"user", func(s *Shaper) {
+			s.SetUser("alice", ShapeRule{Download: Rate{BytesPerSecond: 100000, Burst: 10000}})
+			s.SetUser("", ShapeRule{Download: Rate{BytesPerSecond: 1000}})
+		}},
+		{"host", func(s *Shaper) {
+			s.SetHost("*.example.com", ShapeRule{Download: Rate{BytesPerSecond: 100000, Burst: 10000}})
+			s.SetHost("*", ShapeRule{Download: Rate{BytesPerSecond: 1000}})
+		}},
+		{"slowest rule", func(s *Shaper) {
+			s.SetGlobal(ShapeRule{Download: Rate{BytesPerSecond: 1e6}})
+			s.SetUser("alice", ShapeRule{Download: Rate{BytesPerSecond: 100000, Burst: 10000}})
+			s.SetHost("*", ShapeRule{Upload: Rate{BytesPerSecond: 1000}})
+		}},
+	}
+	for _, tt := range tests {
+		s := NewShaper()
+		tt.set(s)
+		conn, _ := testShapedConn(t, s, "alice", "www.example.com:443")
+		// 60000 bytes take 0.5s at 100000 bytes per second after burst.
+		start := time.Now()
+		if n, err := conn.Write(make([]byte, 60000)); n != 60000 || err != nil {
+			t.Fatalf("%s: wrote %d, %v", tt.name, n, err)
+		}
+		if d := time.Since(start); d < 400*time.Millisecond || d > 800*time.Millisecond {
+			t.Errorf("%s: wrote in %v, want 500ms", tt.name, d)
+		}
+	}
+}
+
+func TestShaperLiveChange(t *testing.T) {
+	s := NewShaper()
+	s.SetUser("alice", ShapeRule{Download: Rate{BytesPerSecond: 10000, Burst: 1000}})
+	conn, _ := testShapedConn(t, s, "alice", "www.example.com")
+	done := make(chan time.Time, 1)
+	go func() {
+		conn.Write(make([]byte, 1000000))
+		done <- time.Now()
+	}()
+
+	// Removed rule applies to open transfer, which would take 100s.
+	time.Sleep(200 * time.Millisecond)
+	changed := time.Now()
+	s.SetUser("alice", ShapeRule{})
+	select {
+	case end := <-done:
+		if d := end.Sub(changed); d > 300*time.Millisecond {
+			t.Errorf("transfer finished in %v after rule is removed", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("removed rule doesn't apply to open transfer")
+	}
+
+	// Added rule applies to open transfer.
+	conn, n := testShapedConn(t, s, "alice", "www.example.com")
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		b := make([]byte, 1000)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := s.SetHost("*.example.com", ShapeRule{Download: Rate{BytesPerSecond: 20000, Burst: 1000}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	before := atomic.LoadInt64(n)
+	time.Sleep(500 * time.Millisecond)
+	if got := atomic.LoadInt64(n) - before; got < 7000 || got > 13000 {
+		t.Errorf("%d bytes in 500ms after rule is added, want 10000", got)
+	}
+}
+
+func TestShaperBuckets(t *testing.T) {
+	s := NewShaper()
+	s.SetGlobal(ShapeRule{Download: Rate{BytesPerSecond: 1000}})
+	buckets := s.acquire(DirectionDownstream, "alice", "example.com")
+	if len(buckets) != 3 {
+		t.Fatalf("%d buckets, want global, user and host", len(buckets))
+	}
+	s.wait(buckets, 1000)
+	s.release(buckets)
+	// Drained bucket is kept until it's full, so new transfers don't get a
+	// fresh burst.
+	if len(s.buckets) != 1 {
+		t.Errorf("%d buckets kept after release, want drained one", len(s.buckets))
+	}
+	s.mu.Lock()
+	s.nextSweep = time.Time{}
+	s.sweep(time.Now().Add(2 * time.Second))
+	s.mu.Unlock()
+	if len(s.buckets) != 0 {
+		t.Errorf("%d buckets kept after sweep", len(s.buckets))
+	}
+	if err := s.SetHost("[", ShapeRule{}); err == nil {
+		t.Error("malformed host pattern is accepted")
+	}
+}
+
+func TestShaperProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100000))
+	}))
+	defer origin.Close()
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prx.Rt = &http.Transport{}
+	prx.Shaper = NewShaper()
+	prx.Shaper.SetHost("127.0.0.1", ShapeRule{Download: Rate{BytesPerSecond: 200000, Burst: 20000}})
+	srv := httptest.NewServer(prx)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// 100000 bytes take 0.4s at 200000 bytes per second after burst.
+	start := time.Now()
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if d := time.Since(start); n != 100000 || d < 300*time.Millisecond || d > 800*time.Millisecond {
+		t.Errorf("%d bytes in %v, want 100000 bytes in 400ms", n, d)
+	}
+}
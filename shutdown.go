@@ -0,0 +1,149 @@
+package httpproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// hijackedConns keeps connections hijacked by CONNECT requests to drain them
+// on shutdown.
+type hijackedConns struct {
+	mu       sync.Mutex
+	conns    map[*Context]*hijackedConn
+	shutdown bool
+	drained  chan struct{}
+}
+
+type hijackedConn struct {
+	conn net.Conn
+	idle bool
+}
+
+// add adds hijacked connection of ctx. If proxy is shutting down, it returns
+// false.
+func (h *hijackedConns) add(ctx *Context, conn net.Conn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shutdown {
+		return false
+	}
+	if h.conns == nil {
+		h.conns = make(map[*Context]*hijackedConn)
+	}
+	h.conns[ctx] = &hijackedConn{conn: conn}
+	return true
+}
+
+// remove removes hijacked connection of ctx, if any.
+func (h *hijackedConns) remove(ctx *Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.conns[ctx]; !ok {
+		return
+	}
+	delete(h.conns, ctx)
+	if h.shutdown && len(h.conns) == 0 {
+		close(h.drained)
+	}
+}
+
+// setIdle marks MITM session of ctx idle between requests, or active. An idle
+// session is closed on shutdown. If proxy is shutting down, it returns false
+// and session must not read more requests.
+func (h *hijackedConns) setIdle(ctx *Context, idle bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.conns[ctx]
+	if !ok {
+		return true
+	}
+	if h.shutdown {
+		return false
+	}
+	c.idle = idle
+	return true
+}
+
+// shuttingDown returns true if proxy is shutting down.
+func (h *hijackedConns) shuttingDown() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.shutdown
+}
+
+// drainResponseWriter is a http.ResponseWriter of MITM session sets
+// "Connection: close" to response if proxy is shutting down, because session
+// closes after it.
+type drainResponseWriter struct {
+	http.ResponseWriter
+	h *hijackedConns
+}
+
+func (w *drainResponseWriter) WriteHeader(statusCode int) {
+	if w.h.shuttingDown() {
+		w.Header().Set("Connection", "close")
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *drainResponseWriter) Write(b []byte) (int, error) {
+	if w.h.shuttingDown() {
+		w.Header().Set("Connection", "close")
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// startShutdown stops accepting connections, closes idle MITM sessions and
+// returns a channel closed after all connections are removed.
+func (h *hijackedConns) startShutdown() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shutdown {
+		return h.drained
+	}
+	h.shutdown = true
+	h.drained = make(chan struct{})
+	for _, c := range h.conns {
+		if c.idle {
+			c.conn.Close()
+		}
+	}
+	if len(h.conns) == 0 {
+		close(h.drained)
+	}
+	return h.drained
+}
+
+// closeAll closes all connections and returns count of connections closed.
+func (h *hijackedConns) closeAll() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, c := range h.conns {
+		if !c.idle {
+			n++
+		}
+		c.conn.Close()
+	}
+	return n
+}
+
+// Shutdown gracefully shuts down tunnels and MITM sessions of proxy. It
+// refuses new CONNECT requests, closes idle MITM sessions, and waits active
+// tunnels and MITM requests to finish. MITM sessions are closed after current
+// response. If ctx expires first, remaining connections are closed and it
+// returns count of them with ctx.Err().
+//
+// Connections hijacked by CONNECT requests aren't tracked by http.Server, so
+// call this method along with http.Server.Shutdown.
+func (prx *Proxy) Shutdown(ctx context.Context) (dropped int, err error) {
+	drained := prx.hijacked.startShutdown()
+	select {
+	case <-drained:
+		return 0, nil
+	case <-ctx.Done():
+		return prx.hijacked.closeAll(), ctx.Err()
+	}
+}
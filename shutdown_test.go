@@ -0,0 +1,205 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestShutdownProxy returns a proxy server which tunnels to host
+// "mitm.example:443" by MITM with responses of OnRequest, and to other hosts
+// by plain tunnels. Requests to path "/block" are responded after a value is
+// sent to release.
+func newTestShutdownProxy(t *testing.T) (prx *Proxy, srv *httptest.Server, release chan struct{}) {
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prx.OnConnect = func(ctx *Context, host string) (ConnectAction, string) {
+		if host == "mitm.example:443" {
+			return ConnectMitm, host
+		}
+		return ConnectProxy, host
+	}
+	release = make(chan struct{})
+	prx.OnRequest = func(ctx *Context, req *http.Request) *http.Response {
+		if req.URL.Path == "/block" {
+			<-release
+		}
+		return InMemoryResponse(200, nil, []byte("hello"))
+	}
+	srv = httptest.NewServer(prx)
+	t.Cleanup(srv.Close)
+	return prx, srv, release
+}
+
+// testShutdownConnect sends CONNECT request to host through proxy server, and
+// returns client connection with status code of response.
+func testShutdownConnect(t *testing.T, srv *httptest.Server, host string) (net.Conn, *bufio.Reader, int) {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, resp.StatusCode
+}
+
+// testShutdownMitm opens a MITM session, and returns TLS connection of it.
+func testShutdownMitm(t *testing.T, srv *httptest.Server) (*tls.Conn, *bufio.Reader) {
+	conn, r, code := testShutdownConnect(t, srv, "mitm.example:443")
+	if code != http.StatusOK {
+		t.Fatalf("CONNECT: status %d", code)
+	}
+	tlsConn := tls.Client(&readerConn{Conn: conn, r: r}, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return tlsConn, bufio.NewReader(tlsConn)
+}
+
+// testShutdownGet sends a request of path over MITM session.
+func testShutdownGet(conn *tls.Conn, r *bufio.Reader, path string) (*http.Response, error) {
+	io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: mitm.example\r\n\r\n")
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+// isClosed checks connection is closed by peer within a second.
+func isClosed(r io.Reader) bool {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, r)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	l := testEchoServer(t)
+	prx, srv, release := newTestShutdownProxy(t)
+	tunnel, tunnelReader, code := testShutdownConnect(t, srv, l.Addr().String())
+	if code != http.StatusOK {
+		t.Fatalf("CONNECT: status %d", code)
+	}
+	idleConn, idleReader := testShutdownMitm(t, srv)
+	if _, err := testShutdownGet(idleConn, idleReader, "/"); err != nil {
+		t.Fatal(err)
+	}
+	activeConn, activeReader := testShutdownMitm(t, srv)
+	activeResp := make(chan *http.Response, 1)
+	go func() {
+		resp, err := testShutdownGet(activeConn, activeReader, "/block")
+		if err != nil {
+			t.Error(err)
+		}
+		activeResp <- resp
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		dropped, err := prx.Shutdown(ctx)
+		if dropped != 0 {
+			t.Errorf("%d connections dropped", dropped)
+		}
+		result <- err
+	}()
+
+	// Idle MITM session is closed, and new tunnels are refused.
+	if !isClosed(idleReader) {
+		t.Error("idle MITM session isn't closed")
+	}
+	if _, _, code := testShutdownConnect(t, srv, l.Addr().String()); code != http.StatusServiceUnavailable {
+		t.Errorf("CONNECT in shutdown: status %d, want 503", code)
+	}
+
+	// Active MITM session is closed after current response.
+	release <- struct{}{}
+	if resp := <-activeResp; resp == nil || resp.StatusCode != http.StatusOK || !resp.Close {
+		t.Errorf("active MITM request: %v", resp)
+	}
+	if !isClosed(activeReader) {
+		t.Error("active MITM session isn't closed after response")
+	}
+
+	// Tunnel is kept until it's closed.
+	b := make([]byte, 4)
+	io.WriteString(tunnel, "ping")
+	if _, err := io.ReadFull(tunnelReader, b); err != nil {
+		t.Errorf("tunnel in shutdown: %v", err)
+	}
+	select {
+	case err := <-result:
+		t.Fatalf("Shutdown returned %v before tunnel is closed", err)
+	default:
+	}
+	tunnel.Close()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown doesn't return after tunnels are closed")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	l := testEchoServer(t)
+	prx, srv, _ := newTestShutdownProxy(t)
+	var readers []io.Reader
+	for i := 0; i < 2; i++ {
+		_, r, code := testShutdownConnect(t, srv, l.Addr().String())
+		if code != http.StatusOK {
+			t.Fatalf("CONNECT: status %d", code)
+		}
+		readers = append(readers, r)
+	}
+	idleConn, idleReader := testShutdownMitm(t, srv)
+	if _, err := testShutdownGet(idleConn, idleReader, "/"); err != nil {
+		t.Fatal(err)
+	}
+	readers = append(readers, idleReader)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	dropped, err := prx.Shutdown(ctx)
+	if dropped != 2 || err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: %d dropped, %v, want 2 dropped at deadline", dropped, err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > time.Second {
+		t.Errorf("Shutdown returned in %v", d)
+	}
+	for i, r := range readers {
+		if !isClosed(r) {
+			t.Errorf("connection %d isn't closed", i)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package httpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Max length of a line passed to OnMailLine. Longer lines are passed in
+// chunks.
+const mailLineMax = 65536
+
+// starttlsState keeps state of a pending STARTTLS command.
+type starttlsState struct {
+	mu      sync.Mutex
+	pending bool
+	tag     string
+	result  chan bool
+}
+
+func (s *starttlsState) set(tag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = true
+	s.tag = tag
+}
+
+func (s *starttlsState) get() (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending, s.tag
+}
+
+func (s *starttlsState) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = false
+	s.tag = ""
+}
+
+// starttlsCommand checks the client line is STARTTLS command of action and
+// returns its tag.
+func starttlsCommand(action ConnectAction, line []byte) (ok bool, tag string) {
+	fields := strings.Fields(string(line))
+	switch action {
+	case ConnectMitmSMTP:
+		return len(fields) == 1 && strings.EqualFold(fields[0], "STARTTLS"), ""
+	case ConnectMitmIMAP:
+		if len(fields) == 2 && strings.EqualFold(fields[1], "STARTTLS") {
+			return true, fields[0]
+		}
+	case ConnectMitmPOP3:
+		return len(fields) == 1 && strings.EqualFold(fields[0], "STLS"), ""
+	}
+	return false, ""
+}
+
+// starttlsResponse checks the server line is the final response to STARTTLS
+// command of action, and whether it's positive.
+func starttlsResponse(action ConnectAction, tag string, line []byte) (final bool, ok bool) {
+	s := strings.TrimRight(string(line), "\r\n")
+	switch action {
+	case ConnectMitmSMTP:
+		if len(s) < 3 || (len(s) > 3 && s[3] != ' ') {
+			return false, false
+		}
+		return true, s[0] == '2'
+	case ConnectMitmIMAP:
+		fields := strings.Fields(s)
+		if len(fields) < 2 || fields[0] != tag {
+			return false, false
+		}
+		return true, strings.EqualFold(fields[1], "OK")
+	case ConnectMitmPOP3:
+		if strings.HasPrefix(s, "+OK") {
+			return true, true
+		}
+		if strings.HasPrefix(s, "-ERR") {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// readerConn is a net.Conn reads from r instead of Conn.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// readLine reads a line including line ending, or a chunk of a long line.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = nil
+	}
+	return append([]byte(nil), line...), err
+}
+
+// remoteTLSConfig returns TLS client config to remote given host. It's based
+// on TLS config of Proxy.Rt, if it's *http.Transport or *MirrorTransport.
+func (ctx *Context) remoteTLSConfig(host string) *tls.Config {
+	var base *tls.Config
+	switch rt := ctx.Prx.Rt.(type) {
+	case *http.Transport:
+		base = rt.TLSClientConfig
+	case *MirrorTransport:
+		base = rt.Base.TLSClientConfig
+		if ctx.ClientHello != nil {
+			base = MirrorTLSConfig(base, ctx.ClientHello)
+		}
+	}
+	tlsConfig := &tls.Config{}
+	if base != nil {
+		tlsConfig = base.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = stripPort(host)
+	}
+	if ctx.RemoteClientCert == nil && ctx.Prx.ClientCerts != nil {
+		ctx.RemoteClientCert = ctx.Prx.ClientCerts.Lookup(host, ctx.AuthUser)
+	}
+	if ctx.RemoteClientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*ctx.RemoteClientCert}
+		tlsConfig.GetClientCertificate = nil
+	}
+	return tlsConfig
+}
+
+func (ctx *Context) onMailLine(dir Direction, line []byte) (newLine []byte, err error) {
+	defer func() {
+		if e, ok := recover().(error); ok {
+			ctx.doError("Connect", ErrPanic, e)
+			err = e
+		}
+	}()
+	return ctx.Prx.OnMailLine(ctx, dir, line)
+}
+
+// doStarttls relays mail protocol in plaintext until STARTTLS, performs TLS
+// handshakes with client by forged certificate and with remote, then relays
+// decrypted lines through OnMailLine.
+func (ctx *Context) doStarttls(hijConn net.Conn, remoteConn net.Conn) {
+	defer hijConn.Close()
+	defer remoteConn.Close()
+	if ctx.timeouts != nil {
+		hijConn = &timeoutConn{Conn: hijConn, t: ctx.timeouts}
+		remoteConn = &timeoutConn{Conn: remoteConn, t: ctx.timeouts}
+	}
+	hijConn = ctx.quotaConn(ctx.shapeConn(hijConn, DirectionDownstream))
+	remoteConn = ctx.quotaConn(ctx.shapeConn(remoteConn, DirectionUpstream))
+	clientReader := bufio.NewReaderSize(&prefixConn{Conn: hijConn, prefix: ctx.peekedBytes}, mailLineMax)
+	remoteReader := bufio.NewReaderSize(remoteConn, mailLineMax)
+	if ctx.Prx.Pcap != nil {
+		ctx.pcapStream = ctx.Prx.Pcap.NewStream(hijConn.RemoteAddr(), remoteConn.RemoteAddr())
+		defer ctx.pcapStream.Close()
+	}
+	state := &starttlsState{result: make(chan bool, 1)}
+	remoteDone := make(chan struct{})
+	go func() {
+		defer close(remoteDone)
+		for {
+			line, err := readLine(remoteReader)
+			if len(line) > 0 {
+				if ctx.pcapStream != nil {
+					ctx.pcapStream.Write(DirectionDownstream, line)
+				}
+				n, err := hijConn.Write(line)
+				ctx.tunnel.add(DirectionDownstream, int64(n))
+				if err != nil {
+					ctx.tunnelClosed(SideClient, err)
+					ctx.doTunnelError("Connect", ErrResponseWrite, err)
+					hijConn.Close()
+					return
+				}
+				if pending, tag := state.get(); pending {
+					if final, ok := starttlsResponse(ctx.ConnectAction, tag, line); final {
+						state.clear()
+						state.result <- ok
+						if ok {
+							return
+						}
+					}
+				}
+			}
+			if err != nil {
+				ctx.tunnelClosed(SideRemote, err)
+				ctx.doTunnelError("Connect", ErrResponseWrite, err)
+				hijConn.Close()
+				return
+			}
+		}
+	}()
+	for started := false; !started; {
+		line, err := readLine(clientReader)
+		if len(line) > 0 {
+			isStarttls, tag := starttlsCommand(ctx.ConnectAction, line)
+			if isStarttls {
+				state.set(tag)
+			}
+			if ctx.pcapStream != nil {
+				ctx.pcapStream.Write(DirectionUpstream, line)
+			}
+			n, err := remoteConn.Write(line)
+			ctx.tunnel.add(DirectionUpstream, int64(n))
+			if err != nil {
+				ctx.tunnelClosed(SideRemote, err)
+				ctx.doTunnelError("Connect", ErrRequestRead, err)
+				return
+			}
+			if isStarttls {
+				select {
+				case started = <-state.result:
+				case <-remoteDone:
+					return
+				}
+			}
+		}
+		if err != nil && !started {
+			ctx.tunnelClosed(SideClient, err)
+			ctx.doTunnelError("Connect", ErrRequestRead, err)
+			remoteConn.Close()
+			<-remoteDone
+			return
+		}
+	}
+	<-remoteDone
+
+	cert := ctx.Prx.signer.SignHost(ctx.ConnectHost)
+	if cert == nil {
+		ctx.tunnelClosed(SideProxy, nil)
+		ctx.doError("Connect", ErrTLSSignHost, nil)
+		return
+	}
+	clientConn := net.Conn(&readerConn{Conn: hijConn, r: clientReader})
+	if ctx.pcapStream != nil {
+		clientConn = &pcapngConn{Conn: clientConn, s: ctx.pcapStream}
+	}
+	ctx.peekClientHello(clientConn, 0)
+	clientTLSConn := tls.Server(&prefixConn{Conn: clientConn, prefix: ctx.peekedBytes}, ctx.mitmTLSConfig(cert))
+	if err := clientTLSConn.Handshake(); err != nil {
+		ctx.tunnelClosed(SideClient, err)
+		ctx.doTunnelError("Connect", ErrTLSHandshake, err)
+		return
+	}
+	defer clientTLSConn.Close()
+	ctx.MitmClientCerts = clientTLSConn.ConnectionState().PeerCertificates
+	if len(ctx.MitmClientCerts) > 0 && ctx.Prx.OnMitmClientCert != nil {
+		if remoteCert := ctx.onMitmClientCert(ctx.MitmClientCerts); remoteCert != nil {
+			ctx.RemoteClientCert = remoteCert
+		}
+	}
+	remoteTLSConn := tls.Client(&readerConn{Conn: remoteConn, r: remoteReader},
+		ctx.remoteTLSConfig(ctx.ConnectHost))
+	if err := remoteTLSConn.Handshake(); err != nil {
+		ctx.tunnelClosed(SideRemote, err)
+		ctx.doTunnelError("Connect", ErrRemoteConnect, err)
+		return
+	}
+	defer remoteTLSConn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	relay := func(dir Direction, src io.Reader, dst net.Conn, errWhere *Error) {
+		defer wg.Done()
+		defer clientTLSConn.Close()
+		defer remoteTLSConn.Close()
+		srcSide, dstSide := SideClient, SideRemote
+		if dir == DirectionDownstream {
+			srcSide, dstSide = SideRemote, SideClient
+		}
+		r := bufio.NewReaderSize(src, mailLineMax)
+		for {
+			line, err := readLine(r)
+			if len(line) > 0 {
+				if ctx.Prx.OnMailLine != nil {
+					var hookErr error
+					if line, hookErr = ctx.onMailLine(dir, line); hookErr != nil {
+						ctx.tunnelClosed(SideProxy, &tunnelAbortError{hookErr})
+						ctx.doError("Connect", ErrTunnelAborted, hookErr)
+						return
+					}
+				}
+				n, err := dst.Write(line)
+				ctx.tunnel.add(dir, int64(n))
+				if err != nil {
+					ctx.tunnelClosed(dstSide, err)
+					ctx.doTunnelError("Connect", errWhere, err)
+					return
+				}
+			}
+			if err != nil {
+				ctx.tunnelClosed(srcSide, err)
+				ctx.doTunnelError("Connect", errWhere, err)
+				return
+			}
+		}
+	}
+	go relay(DirectionUpstream, clientTLSConn, remoteTLSConn, ErrRequestRead)
+	go relay(DirectionDownstream, remoteTLSConn, clientTLSConn, ErrResponseWrite)
+	wg.Wait()
+}
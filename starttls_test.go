@@ -0,0 +1,211 @@
+package httpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMailProtocol describes a mail protocol served by testMailServer and
+// spoken by testMailClient.
+type testMailProtocol struct {
+	name     string
+	action   ConnectAction
+	greeting string
+	starttls string
+	started  string
+	command  string
+	reply    string
+}
+
+var testMailProtocols = []testMailProtocol{
+	{"SMTP", ConnectMitmSMTP, "220 mail ESMTP\r\n", "STARTTLS\r\n", "220 Ready to start TLS\r\n", "NOOP\r\n", "250 OK\r\n"},
+	{"IMAP", ConnectMitmIMAP, "* OK IMAP ready\r\n", "a1 STARTTLS\r\n", "a1 OK Begin TLS\r\n", "a2 NOOP\r\n", "a2 OK NOOP done\r\n"},
+	{"POP3", ConnectMitmPOP3, "+OK POP3 ready\r\n", "STLS\r\n", "+OK Begin TLS\r\n", "NOOP\r\n", "+OK\r\n"},
+}
+
+// testMailServer is a stand-in mail server of protocol. It greets, starts TLS
+// on STARTTLS command, and replies command over TLS.
+func testMailServer(t *testing.T, p testMailProtocol, cert tls.Certificate) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(p.greeting))
+				r := bufio.NewReader(conn)
+				if line, err := r.ReadString('\n'); err != nil || line != p.starttls {
+					return
+				}
+				conn.Write([]byte(p.started))
+				tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				r = bufio.NewReader(tlsConn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == p.command {
+						tlsConn.Write([]byte(p.reply))
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+// newTestMailProxy returns a proxy server tunnels to mail servers by action,
+// trusting cert of them.
+func newTestMailProxy(t *testing.T, action ConnectAction, cert tls.Certificate) (*Proxy, *httptest.Server) {
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	prx.Rt = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	prx.OnConnect = func(ctx *Context, host string) (ConnectAction, string) {
+		return action, host
+	}
+	prx.OnError = func(ctx *Context, where string, err *Error, opErr error) {
+		t.Logf("%s: %v: %v", where, err, opErr)
+	}
+	srv := httptest.NewServer(prx)
+	t.Cleanup(srv.Close)
+	return prx, srv
+}
+
+// testMailClient connects to addr through proxy server, and reads greeting.
+func testMailClient(t *testing.T, srv *httptest.Server, addr string, p testMailProtocol) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v, %v", resp, err)
+	}
+	if line, err := r.ReadString('\n'); line != p.greeting {
+		t.Fatalf("greeting = %q, %v, want %q", line, err, p.greeting)
+	}
+	conn.Write([]byte(p.starttls))
+	if line, err := r.ReadString('\n'); line != p.started {
+		t.Fatalf("STARTTLS response = %q, %v, want %q", line, err, p.started)
+	}
+	return conn, r
+}
+
+func TestStarttls(t *testing.T) {
+	cert := testCertificate(t)
+	for _, p := range testMailProtocols {
+		l := testMailServer(t, p, cert)
+		prx, srv := newTestMailProxy(t, p.action, cert)
+		var mu sync.Mutex
+		var lines []string
+		prx.OnMailLine = func(ctx *Context, dir Direction, line []byte) ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			lines = append(lines, string(line))
+			return line, nil
+		}
+		stats := make(chan *TunnelStats, 1)
+		prx.OnTunnelClose = func(ctx *Context, s *TunnelStats) { stats <- s }
+
+		conn, r := testMailClient(t, srv, l.Addr().String(), p)
+		tlsConn := tls.Client(&readerConn{Conn: conn, r: r}, &tls.Config{InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("%s: handshake: %v", p.name, err)
+		}
+		if err := tlsConn.ConnectionState().PeerCertificates[0].VerifyHostname("127.0.0.1"); err != nil {
+			t.Errorf("%s: forged certificate: %v", p.name, err)
+		}
+		tlsConn.Write([]byte(p.command))
+		if line, err := bufio.NewReader(tlsConn).ReadString('\n'); line != p.reply {
+			t.Errorf("%s: reply = %q, %v, want %q", p.name, line, err, p.reply)
+		}
+		tlsConn.Close()
+		select {
+		case s := <-stats:
+			if s.ClosedBy != SideClient {
+				t.Errorf("%s: closed by %v, want client", p.name, s.ClosedBy)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: tunnel isn't closed", p.name)
+		}
+		mu.Lock()
+		if want := []string{p.command, p.reply}; strings.Join(lines, "") != strings.Join(want, "") {
+			t.Errorf("%s: mail lines = %q, want %q", p.name, lines, want)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestStarttlsClientHandshakeError(t *testing.T) {
+	cert := testCertificate(t)
+	p := testMailProtocols[0]
+	l := testMailServer(t, p, cert)
+	prx, srv := newTestMailProxy(t, p.action, cert)
+	stats := make(chan *TunnelStats, 1)
+	prx.OnTunnelClose = func(ctx *Context, s *TunnelStats) { stats <- s }
+
+	conn, _ := testMailClient(t, srv, l.Addr().String(), p)
+	conn.Write([]byte("not a TLS handshake\r\n"))
+	select {
+	case s := <-stats:
+		if s.ClosedBy != SideClient || s.Err == nil {
+			t.Errorf("closed by %v with %v, want client with error", s.ClosedBy, s.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel isn't closed")
+	}
+}
+
+func TestStarttlsPcapClosed(t *testing.T) {
+	cert := testCertificate(t)
+	p := testMailProtocols[0]
+	l := testMailServer(t, p, cert)
+	prx, srv := newTestMailProxy(t, p.action, cert)
+	prx.Pcap = NewPcapngWriter(ioutil.Discard)
+	closed := make(chan [2]bool, 1)
+	prx.OnTunnelClose = func(ctx *Context, s *TunnelStats) {
+		ctx.pcapStream.mu.Lock()
+		defer ctx.pcapStream.mu.Unlock()
+		closed <- ctx.pcapStream.closed
+	}
+
+	// Capture is finished even if TLS handshake with client fails.
+	conn, _ := testMailClient(t, srv, l.Addr().String(), p)
+	conn.Write([]byte("not a TLS handshake\r\n"))
+	select {
+	case c := <-closed:
+		if !c[DirectionUpstream] || !c[DirectionDownstream] {
+			t.Errorf("pcap stream closed %v, want both directions", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel isn't closed")
+	}
+}
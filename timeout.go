@@ -0,0 +1,162 @@
+package httpproxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// tunnelTimeouts keeps deadlines of tunnel connections. Each read or write on
+// the tunnel moves deadlines of all connections, so idle timeout fires only if
+// there is no traffic in both directions.
+type tunnelTimeouts struct {
+	mu        sync.Mutex
+	conns     []net.Conn
+	idle      time.Duration
+	end       time.Time
+	headerEnd time.Time
+	reported  bool
+}
+
+// newTunnelTimeouts returns a new tunnelTimeouts for conns given Proxy
+// timeouts, and sets initial deadlines. If there are no timeouts, it returns
+// nil.
+func (ctx *Context) newTunnelTimeouts(conns ...net.Conn) *tunnelTimeouts {
+	prx := ctx.Prx
+	if prx.IdleTimeout <= 0 && prx.MaxTunnelLifetime <= 0 && prx.MitmHeaderTimeout <= 0 {
+		return nil
+	}
+	t := &tunnelTimeouts{conns: conns, idle: prx.IdleTimeout}
+	if prx.MaxTunnelLifetime > 0 {
+		t.end = time.Now().Add(prx.MaxTunnelLifetime)
+	}
+	t.touch()
+	return t
+}
+
+// deadline returns the earliest deadline from now. Zero time means no
+// deadline.
+func (t *tunnelTimeouts) deadline(now time.Time) time.Time {
+	var d time.Time
+	if t.idle > 0 {
+		d = now.Add(t.idle)
+	}
+	for _, e := range []time.Time{t.end, t.headerEnd} {
+		if !e.IsZero() && (d.IsZero() || e.Before(d)) {
+			d = e
+		}
+	}
+	return d
+}
+
+// touch moves deadlines of connections after traffic.
+func (t *tunnelTimeouts) touch() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.deadline(time.Now())
+	for _, c := range t.conns {
+		c.SetDeadline(d)
+	}
+}
+
+// setHeaderTimeout starts timeout of reading request header, or stops it if
+// timeout is 0.
+func (t *tunnelTimeouts) setHeaderTimeout(timeout time.Duration) {
+	t.mu.Lock()
+	t.headerEnd = time.Time{}
+	if timeout > 0 {
+		t.headerEnd = time.Now().Add(timeout)
+	}
+	t.mu.Unlock()
+	t.touch()
+}
+
+// fired returns Error of the timeout caused err, or nil if err isn't caused
+// by a timeout. It returns the Error only once for the tunnel; after that it
+// returns ErrTunnelTimedOut to suppress duplicate reports.
+func (t *tunnelTimeouts) fired(err error) *Error {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reported {
+		return errTunnelTimedOut
+	}
+	t.reported = true
+	now := time.Now()
+	switch {
+	case !t.end.IsZero() && !now.Before(t.end):
+		return ErrLifetimeExceeded
+	case !t.headerEnd.IsZero() && !now.Before(t.headerEnd):
+		return ErrHeaderTimeout
+	}
+	return ErrIdleTimeout
+}
+
+// Returned by tunnelTimeouts.fired for a timeout already reported.
+var errTunnelTimedOut = NewError("tunnel timed out")
+
+// timeoutConn is a net.Conn moves tunnel deadlines on each read and write.
+type timeoutConn struct {
+	net.Conn
+	t *tunnelTimeouts
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.t.touch()
+	}
+	return n, err
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.t.touch()
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.t.touch()
+	}
+	return n, err
+}
+
+// dial connects to remote host of tunnel within Proxy.DialTimeout.
+func (ctx *Context) dial(host string) (net.Conn, error) {
+	return net.DialTimeout("tcp", host, ctx.Prx.DialTimeout)
+}
+
+// dialError returns Error of err returned by dial.
+func dialError(err error) *Error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrDialTimeout
+	}
+	return ErrRemoteConnect
+}
+
+// doTunnelError reports err of tunnel as errWhere, as the timeout fired, or as
+// ErrQuotaExceeded if quota closed it.
+// Errors of closed connections and timeouts already reported aren't reported.
+func (ctx *Context) doTunnelError(where string, errWhere *Error, err error) {
+	if err == nil {
+		return
+	}
+	var qerr *quotaError
+	if errors.As(err, &qerr) {
+		ctx.doError(where, ErrQuotaExceeded, qerr)
+		return
+	}
+	if ctx.timeouts != nil {
+		if e := ctx.timeouts.fired(err); e == errTunnelTimedOut {
+			return
+		} else if e != nil {
+			ctx.doError(where, e, err)
+			return
+		}
+	}
+	if !isConnectionClosed(err) {
+		ctx.doError(where, errWhere, err)
+	}
+}
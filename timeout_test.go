@@ -0,0 +1,162 @@
+package httpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testEchoServer returns a listener of a server echoes received data.
+func testEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// testTimeoutTunnel opens a tunnel of action to addr through prx, and returns
+// client connection and channel of reported errors.
+func testTimeoutTunnel(t *testing.T, prx *Proxy, action ConnectAction, addr string) (net.Conn, *bufio.Reader, chan *Error) {
+	errs := make(chan *Error, 10)
+	prx.OnConnect = func(ctx *Context, host string) (ConnectAction, string) {
+		return action, host
+	}
+	prx.OnError = func(ctx *Context, where string, err *Error, opErr error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	srv := httptest.NewServer(prx)
+	t.Cleanup(srv.Close)
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v, %v", resp, err)
+	}
+	return conn, r, errs
+}
+
+// waitTunnelError waits until the tunnel is closed, and checks want is
+// reported.
+func waitTunnelError(t *testing.T, r io.Reader, errs chan *Error, want *Error) {
+	start := time.Now()
+	io.Copy(ioutil.Discard, r)
+	if time.Since(start) > 4*time.Second {
+		t.Fatal("tunnel isn't closed")
+	}
+	for {
+		select {
+		case err := <-errs:
+			if err == want {
+				return
+			}
+			t.Logf("reported %v", err)
+		case <-time.After(time.Second):
+			t.Fatalf("%v isn't reported", want)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	l := testEchoServer(t)
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prx.IdleTimeout = 100 * time.Millisecond
+	conn, r, errs := testTimeoutTunnel(t, prx, ConnectProxy, l.Addr().String())
+
+	// Traffic keeps tunnel open beyond idle timeout.
+	b := make([]byte, 4)
+	for i := 0; i < 6; i++ {
+		io.WriteString(conn, "ping")
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatalf("echo %d: %v", i, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	start := time.Now()
+	waitTunnelError(t, r, errs, ErrIdleTimeout)
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("closed in %v after traffic", d)
+	}
+}
+
+func TestMaxTunnelLifetime(t *testing.T) {
+	l := testEchoServer(t)
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prx.IdleTimeout = time.Second
+	prx.MaxTunnelLifetime = 200 * time.Millisecond
+	start := time.Now()
+	conn, r, errs := testTimeoutTunnel(t, prx, ConnectProxy, l.Addr().String())
+
+	// Traffic doesn't extend lifetime.
+	b := make([]byte, 4)
+	for {
+		io.WriteString(conn, "ping")
+		if _, err := io.ReadFull(r, b); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond || d > time.Second {
+		t.Errorf("closed in %v, want lifetime", d)
+	}
+	waitTunnelError(t, r, errs, ErrLifetimeExceeded)
+}
+
+func TestMitmHeaderTimeout(t *testing.T) {
+	prx, err := NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prx.IdleTimeout = time.Second
+	prx.MitmHeaderTimeout = 100 * time.Millisecond
+
+	// Client doesn't start TLS handshake.
+	_, r, errs := testTimeoutTunnel(t, prx, ConnectMitm, "example.com:443")
+	waitTunnelError(t, r, errs, ErrHeaderTimeout)
+
+	// Client doesn't send request header after TLS handshake.
+	conn, r, errs := testTimeoutTunnel(t, prx, ConnectMitm, "example.com:443")
+	tlsConn := tls.Client(&readerConn{Conn: conn, r: r}, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	waitTunnelError(t, tlsConn, errs, ErrHeaderTimeout)
+	if d := time.Since(start); d > time.Second/2 {
+		t.Errorf("closed in %v, want header timeout", d)
+	}
+}
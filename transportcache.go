@@ -0,0 +1,69 @@
+package httpproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"sync"
+)
+
+// Max count of transports kept by transportCache.
+const transportCacheMax = 256
+
+// transportCache keeps derived transports by key, so connections with
+// different TLS client parameters aren't pooled together.
+type transportCache struct {
+	mu sync.Mutex
+	m  map[string]*http.Transport
+}
+
+func (c *transportCache) get(key string, newTransport func() *http.Transport) *http.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if tr, ok := c.m[key]; ok {
+		return tr
+	}
+	if c.m == nil {
+		c.m = make(map[string]*http.Transport)
+	}
+	if len(c.m) >= transportCacheMax {
+		for k, tr := range c.m {
+			tr.CloseIdleConnections()
+			delete(c.m, k)
+			break
+		}
+	}
+	tr := newTransport()
+	c.m[key] = tr
+	return tr
+}
+
+func (c *transportCache) closeIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tr := range c.m {
+		tr.CloseIdleConnections()
+	}
+}
+
+// certKey returns key of certificate by its leaf.
+func certKey(cert *tls.Certificate) string {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// withClientCert sets client certificate to TLS config of transport.
+func withClientCert(tr *http.Transport, cert *tls.Certificate) *http.Transport {
+	cfg := &tls.Config{}
+	if tr.TLSClientConfig != nil {
+		cfg = tr.TLSClientConfig.Clone()
+	}
+	cfg.Certificates = []tls.Certificate{*cert}
+	cfg.GetClientCertificate = nil
+	tr.TLSClientConfig = cfg
+	return tr
+}
@@ -0,0 +1,311 @@
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Size of buffer to copy tunnel data through OnTunnelData.
+const tunnelBufferSize = 32 * 1024
+
+// tunnelAbortError is returned by copyTunnel when OnTunnelData or quota
+// aborts the tunnel.
+type tunnelAbortError struct {
+	err error
+}
+
+func (e *tunnelAbortError) Error() string {
+	return e.err.Error()
+}
+
+// kind returns Error to report the abort as. Tunnels closed for quota are
+// reported as ErrQuotaExceeded.
+func (e *tunnelAbortError) kind() *Error {
+	if _, ok := e.err.(*quotaError); ok {
+		return ErrQuotaExceeded
+	}
+	return ErrTunnelAborted
+}
+
+func (ctx *Context) onTunnelData(dir Direction, data []byte) (newData []byte, err error) {
+	defer func() {
+		if e, ok := recover().(error); ok {
+			ctx.doError("Connect", ErrPanic, e)
+			err = e
+		}
+	}()
+	return ctx.Prx.OnTunnelData(ctx, dir, data)
+}
+
+// copyTunnel copies tunnel data from src to dst in the given direction. If
+// OnTunnelData is set, each chunk read from src passes through it.
+func (ctx *Context) copyTunnel(dir Direction, dst io.Writer, src io.Reader) (written int64, err error) {
+	if ctx.Prx.OnTunnelData == nil {
+		return io.Copy(dst, src)
+	}
+	buf := make([]byte, tunnelBufferSize)
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			data, ferr := ctx.onTunnelData(dir, buf[:nr])
+			if ferr != nil {
+				return written, &tunnelAbortError{ferr}
+			}
+			if len(data) > 0 {
+				nw, werr := dst.Write(data)
+				written += int64(nw)
+				if werr != nil {
+					return written, werr
+				}
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// Side specifies a side of proxied connection.
+type Side int
+
+// Constants of Side type.
+const (
+	// SideClient specifies client side of proxy.
+	SideClient = Side(iota)
+
+	// SideRemote specifies remote side of proxy.
+	SideRemote
+
+	// SideProxy specifies proxy itself.
+	SideProxy
+)
+
+// String implements fmt.Stringer.
+func (s Side) String() string {
+	switch s {
+	case SideClient:
+		return "client"
+	case SideRemote:
+		return "remote"
+	case SideProxy:
+		return "proxy"
+	}
+	return "unknown"
+}
+
+// CloseReason specifies reason of tunnel close.
+type CloseReason int
+
+// Constants of CloseReason type.
+const (
+	// CloseClientEOF specifies that client closed its connection.
+	CloseClientEOF = CloseReason(iota)
+
+	// CloseRemoteEOF specifies that remote closed its connection.
+	CloseRemoteEOF
+
+	// CloseReset specifies that a connection is reset.
+	CloseReset
+
+	// CloseTimeout specifies that a connection is timed out.
+	CloseTimeout
+
+	// CloseAborted specifies that proxy closed tunnel, e.g. by OnTunnelData or
+	// at end of non-chunked MITM session.
+	CloseAborted
+
+	// CloseError specifies that tunnel closed by another error.
+	CloseError
+)
+
+// String implements fmt.Stringer.
+func (r CloseReason) String() string {
+	switch r {
+	case CloseClientEOF:
+		return "client EOF"
+	case CloseRemoteEOF:
+		return "remote EOF"
+	case CloseReset:
+		return "reset"
+	case CloseTimeout:
+		return "timeout"
+	case CloseAborted:
+		return "aborted"
+	case CloseError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// TunnelStats keeps traffic statistics of a tunnel. For MITM sessions, it's
+// aggregated over all sub sessions.
+type TunnelStats struct {
+	// Bytes sent from client to remote. For MITM sessions, decrypted bytes.
+	BytesUpstream int64
+
+	// Bytes sent from remote to client. For MITM sessions, decrypted bytes.
+	BytesDownstream int64
+
+	// Count of requests in MITM session.
+	Requests int64
+
+	// Start time of tunnel.
+	Start time.Time
+
+	// Duration of tunnel.
+	Duration time.Duration
+
+	// Reason of close.
+	Reason CloseReason
+
+	// Side closed tunnel first.
+	ClosedBy Side
+
+	// Error caused close, if any.
+	Err error
+}
+
+// tunnelState keeps statistics of an open tunnel.
+type tunnelState struct {
+	mu     sync.Mutex
+	stats  TunnelStats
+	closed bool
+	done   bool
+}
+
+func (t *tunnelState) add(dir Direction, n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if dir == DirectionUpstream {
+		t.stats.BytesUpstream += n
+	} else {
+		t.stats.BytesDownstream += n
+	}
+}
+
+// countConn is a net.Conn counts data passing through it to tunnelState.
+// Read data is counted as upstream, written data as downstream.
+type countConn struct {
+	net.Conn
+	t *tunnelState
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.t.add(DirectionUpstream, int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.t.add(DirectionDownstream, int64(n))
+	return n, err
+}
+
+func (ctx *Context) onTunnelOpen() {
+	defer func() {
+		if err, ok := recover().(error); ok {
+			ctx.doError("Connect", ErrPanic, err)
+		}
+	}()
+	ctx.Prx.OnTunnelOpen(ctx)
+}
+
+func (ctx *Context) onTunnelClose(stats *TunnelStats) {
+	defer func() {
+		if err, ok := recover().(error); ok {
+			ctx.doError("Connect", ErrPanic, err)
+		}
+	}()
+	ctx.Prx.OnTunnelClose(ctx, stats)
+}
+
+// openTunnel starts statistics of tunnel and calls OnTunnelOpen.
+func (ctx *Context) openTunnel() {
+	ctx.tunnel = &tunnelState{stats: TunnelStats{Start: time.Now()}}
+	if ctx.Prx.OnTunnelOpen != nil {
+		ctx.onTunnelOpen()
+	}
+}
+
+// tunnelClosed records the first close of tunnel given side and error read or
+// written on that side. If err is nil or io.EOF, side closed its connection.
+func (ctx *Context) tunnelClosed(side Side, err error) {
+	t := ctx.tunnel
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	s := &t.stats
+	s.ClosedBy = side
+	if err == io.EOF {
+		err = nil
+	}
+	s.Err = err
+	var netErr net.Error
+	switch {
+	case err == nil && side == SideClient:
+		s.Reason = CloseClientEOF
+	case err == nil && side == SideRemote:
+		s.Reason = CloseRemoteEOF
+	case err == nil:
+		s.Reason = CloseAborted
+	case errors.As(err, new(*tunnelAbortError)):
+		s.Reason, s.ClosedBy = CloseAborted, SideProxy
+	case errors.As(err, &netErr) && netErr.Timeout():
+		s.Reason = CloseTimeout
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE):
+		s.Reason = CloseReset
+	default:
+		s.Reason = CloseError
+	}
+}
+
+// tunnelCopyClosed records close of tunnel after copyTunnel in the direction
+// returned err. Side is decided by failed operation.
+func (ctx *Context) tunnelCopyClosed(dir Direction, err error) {
+	src, dst := SideClient, SideRemote
+	if dir == DirectionDownstream {
+		src, dst = SideRemote, SideClient
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "write" {
+		ctx.tunnelClosed(dst, err)
+		return
+	}
+	ctx.tunnelClosed(src, err)
+}
+
+// closeTunnel finishes statistics of tunnel and calls OnTunnelClose once.
+func (ctx *Context) closeTunnel() {
+	t := ctx.tunnel
+	if t == nil {
+		return
+	}
+	ctx.tunnelClosed(SideProxy, nil)
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return
+	}
+	t.done = true
+	t.stats.Duration = time.Since(t.stats.Start)
+	t.stats.Requests = ctx.SubSessionNo
+	stats := t.stats
+	t.mu.Unlock()
+	if ctx.Prx.OnTunnelClose != nil {
+		ctx.onTunnelClose(&stats)
+	}
+}
@@ -2,11 +2,16 @@ package httpproxy
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -123,6 +128,22 @@ func ServeInMemory(w http.ResponseWriter, code int, header http.Header, body []b
 	return ServeResponse(w, InMemoryResponse(code, header, body))
 }
 
+// clientCertHeaderValue returns identity of client certificate in
+// X-Forwarded-Client-Cert format.
+func clientCertHeaderValue(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	v := fmt.Sprintf("Hash=%s;Subject=%s", hex.EncodeToString(sum[:]),
+		strconv.Quote(cert.Subject.String()))
+	for _, u := range cert.URIs {
+		v += ";URI=" + u.String()
+	}
+	for _, d := range cert.DNSNames {
+		v += ";DNS=" + d
+	}
+	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return v + ";Cert=" + strconv.Quote(url.QueryEscape(string(pemCert)))
+}
+
 var hasPort = regexp.MustCompile(`:\d+$`)
 
 func stripPort(s string) string {